@@ -0,0 +1,302 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"hz.tools/sdr"
+)
+
+// Need is something an AppCommand needs set up before it runs. Needs are
+// combined with |, such as NeedRx|NeedOutput.
+type Need uint
+
+const (
+	// NeedRx opens an SDR to receive with. If NeedTx is also set, its
+	// flags are prefixed with "rx-".
+	NeedRx Need = 1 << iota
+
+	// NeedTx opens an SDR to transmit with. If NeedRx is also set, its
+	// flags are prefixed with "tx-".
+	NeedTx
+
+	// NeedOutput opens the --output file, or stdout (which won't be a
+	// terminal without --im-a-weirdo).
+	NeedOutput
+)
+
+// AppOptions describe a command line program, for NewApp.
+type AppOptions struct {
+	// Name is the name of the program, such as "rfcap".
+	Name string
+
+	// Short is the one line description of the program.
+	Short string
+
+	// EnvPrefix is prepended to the name of a flag to get the environment
+	// variable that sets it, such as "RFCAP_" for RFCAP_TIMEOUT. It
+	// defaults to the Name, in upper case. SDR flags always use "RF_".
+	EnvPrefix string
+
+	// Commands are the program's own subcommands.
+	Commands []AppCommand
+}
+
+// AppCommand is a subcommand of a program built by NewApp.
+type AppCommand struct {
+	// Use is the one line usage message, as in cobra.Command.
+	Use string
+
+	// Short is the one line description, as in cobra.Command.
+	Short string
+
+	// Needs is what's set up before Run is called.
+	Needs Need
+
+	// Flags, if set, will add the command's own flags.
+	Flags func(*pflag.FlagSet)
+
+	// Run is called once everything in Needs is set up, and is torn down
+	// after it returns.
+	Run func(ctx context.Context, run *AppRun) error
+}
+
+// AppRun is what's been set up for an AppCommand.
+type AppRun struct {
+	// Cmd is the cobra.Command being run, for its flags.
+	Cmd *cobra.Command
+
+	// Args are the arguments left after the flags.
+	Args []string
+
+	// Rx and RxConfig are the SDR to receive with, if NeedRx was set.
+	Rx       sdr.Receiver
+	RxConfig Config
+
+	// Tx and TxConfig are the SDR to transmit with, if NeedTx was set.
+	Tx       sdr.Transmitter
+	TxConfig Config
+
+	// Output is where to write to, if NeedOutput was set.
+	Output io.Writer
+}
+
+// NewApp will build the cobra root command for a program. It has the
+// version, devices, doctor and completion subcommands, --log-level and
+// --log-format flags, and a subcommand for each of the Commands.
+//
+// Each of the Commands gets the context flags (--timeout, --pprof and so
+// on) and the flags for its Needs, all of which can be set from the
+// environment. They're run as RunSDR is: profiling, the Context, the Needs
+// (the SDRs, then the output), then Run, and the process exits with the
+// ExitStatus or ExitCode if it didn't go well.
+//
+// The caller only needs to Execute the returned command, and exit with the
+// ExitCode of the error it returns.
+func NewApp(opts AppOptions) *cobra.Command {
+	envPrefix := opts.EnvPrefix
+	if envPrefix == "" {
+		envPrefix = strings.ToUpper(strings.Replace(opts.Name, "-", "_", -1)) + "_"
+	}
+
+	rootCmd := &cobra.Command{
+		Use:          opts.Name,
+		Short:        opts.Short,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return setupLogging(cmd.Flags())
+		},
+	}
+
+	flags := rootCmd.PersistentFlags()
+	flags.String("log-level", "info", "[panic|fatal|error|warn|info|debug|trace]")
+	flags.String("log-format", "text", "[text|json]")
+	EnvRegister(envPrefix, flags)
+
+	RegisterVersionSubcommand(rootCmd)
+	RegisterDevicesSubcommand(rootCmd)
+	RegisterDoctorSubcommand(rootCmd)
+	for _, ac := range opts.Commands {
+		rootCmd.AddCommand(newAppCommand(envPrefix, ac))
+	}
+	rootCmd.InitDefaultCompletionCmd()
+
+	return rootCmd
+}
+
+// setupLogging will set up logrus from --log-level and --log-format.
+func setupLogging(flags *pflag.FlagSet) error {
+	levelName, err := flags.GetString("log-level")
+	if err != nil {
+		return err
+	}
+	level, err := log.ParseLevel(levelName)
+	if err != nil {
+		return &SDRError{Kind: ErrInvalidFlag, Err: fmt.Errorf("--log-level: %w", err)}
+	}
+	log.SetLevel(level)
+
+	format, err := flags.GetString("log-format")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return &SDRError{Kind: ErrInvalidFlag, Err: fmt.Errorf("--log-format must be text or json, not %q", format)}
+	}
+	return nil
+}
+
+// appPrefixes will return the SDR flag prefixes for the Needs.
+func appPrefixes(needs Need) (string, string) {
+	if needs&NeedRx != 0 && needs&NeedTx != 0 {
+		return "rx-", "tx-"
+	}
+	return "", ""
+}
+
+// newAppCommand will build the cobra.Command for an AppCommand.
+func newAppCommand(envPrefix string, ac AppCommand) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   ac.Use,
+		Short: ac.Short,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitWith(runAppCommand(cmd, args, ac))
+		},
+	}
+
+	flags := cmd.Flags()
+	RegisterContextFlags(flags)
+	if ac.Needs&NeedOutput != 0 {
+		flags.StringP("output", "o", "-", "file to write to, or - for stdout")
+		RegisterInteractiveFlags(cmd)
+	}
+	if ac.Flags != nil {
+		ac.Flags(flags)
+	}
+	EnvRegister(envPrefix, flags)
+
+	rxPrefix, txPrefix := appPrefixes(ac.Needs)
+	if ac.Needs&NeedRx != 0 {
+		RegisterSDRFlagsWithPrefix(cmd, rxPrefix)
+	}
+	if ac.Needs&NeedTx != 0 {
+		RegisterSDRFlagsWithPrefix(cmd, txPrefix)
+	}
+
+	return cmd
+}
+
+// openOutput will open the --output file, or return stdout if it's "-" (and
+// not a terminal, unless --im-a-weirdo is set).
+func openOutput(cmd *cobra.Command) (io.Writer, func() error, error) {
+	path, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return nil, nil, err
+	}
+	if path == "-" {
+		if err := CheckInteractive(cmd, os.Stdout); err != nil {
+			return nil, nil, err
+		}
+		return os.Stdout, func() error { return nil }, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("--output: %w", err)
+	}
+	return f, f.Close, nil
+}
+
+// runAppCommand is the Run of an AppCommand, returning the exit code, a
+// summary, and the error if the command failed for something other than
+// the Context ending.
+func runAppCommand(cmd *cobra.Command, args []string, ac AppCommand) (int, string, error) {
+	defer pprofFromFlags(cmd)()
+
+	ctx, cancel := Context(cmd)
+	defer cancel()
+
+	run := &AppRun{Cmd: cmd, Args: args}
+	rxPrefix, txPrefix := appPrefixes(ac.Needs)
+
+	if ac.Needs&NeedRx != 0 {
+		dev, cfg, closeDev, err := OpenSDRWithPrefix(cmd, rxPrefix)
+		if err != nil {
+			return ExitCode(err), "Can't open the SDR", err
+		}
+		defer closeDev()
+
+		rx, ok := dev.(sdr.Receiver)
+		if !ok {
+			err := newSDRError(ErrUnsupportedSetting, cfg.Backend, fmt.Errorf("can't receive"))
+			return ExitCode(err), "Can't open the SDR", err
+		}
+		run.Rx, run.RxConfig = rx, cfg
+	}
+
+	if ac.Needs&NeedTx != 0 {
+		dev, cfg, closeDev, err := OpenSDRWithPrefix(cmd, txPrefix)
+		if err != nil {
+			return ExitCode(err), "Can't open the SDR", err
+		}
+		defer closeDev()
+
+		tx, ok := dev.(sdr.Transmitter)
+		if !ok {
+			err := newSDRError(ErrUnsupportedSetting, cfg.Backend, fmt.Errorf("can't transmit"))
+			return ExitCode(err), "Can't open the SDR", err
+		}
+		run.Tx, run.TxConfig = tx, cfg
+	}
+
+	// The output is opened last, so that --output isn't truncated if the
+	// SDRs can't be opened.
+	if ac.Needs&NeedOutput != 0 {
+		out, closeOut, err := openOutput(cmd)
+		if err != nil {
+			return ExitCode(err), "Can't open the output", err
+		}
+		defer closeOut()
+		run.Output = out
+	}
+
+	err := WaitForStart(ctx)
+	if err == nil {
+		err = ac.Run(ctx, run)
+	}
+	return runStatus(ctx, err)
+}
+
+// vim: foldmethod=marker
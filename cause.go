@@ -0,0 +1,131 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrTimeout is the Cause of a Context that ran for --timeout.
+	ErrTimeout = fmt.Errorf("cli: --timeout reached")
+
+	// ErrStopAt is the Cause of a Context that ran until --stop-at.
+	ErrStopAt = fmt.Errorf("cli: --stop-at reached")
+
+	// ErrInterrupted is the Cause of a Context cancelled by SIGINT (C-c).
+	ErrInterrupted = fmt.Errorf("cli: interrupted")
+
+	// ErrTerminated is the Cause of a Context cancelled by SIGTERM.
+	ErrTerminated = fmt.Errorf("cli: terminated")
+
+	// ErrNumSamplesRead is the Cause of a Context cancelled because the
+	// reader from LimitReader read all of --num-samples.
+	ErrNumSamplesRead = fmt.Errorf("cli: --num-samples read")
+
+	// ErrStreamStalled is the Cause of a Context cancelled because no
+	// samples were read from the SDR for too long.
+	ErrStreamStalled = fmt.Errorf("cli: stream stalled")
+)
+
+// canceler will cancel the Context, remembering why. This is
+// context.WithCancelCause, which isn't around until Go 1.20.
+type canceler struct {
+	lock   sync.Mutex
+	cause  error
+	cancel context.CancelFunc
+
+	// deadlineCause is the Cause if the Context's deadline is hit, since
+	// it could be from --timeout or --stop-at.
+	deadlineCause error
+}
+
+type cancelerKey struct{}
+
+// cancelWithCause will cancel the Context from Context, with err as the
+// Cause if it wasn't already cancelled. It returns false if the Context
+// didn't come from Context.
+func cancelWithCause(ctx context.Context, err error) bool {
+	c, ok := ctx.Value(cancelerKey{}).(*canceler)
+	if !ok {
+		return false
+	}
+	c.lock.Lock()
+	if c.cause == nil && ctx.Err() == nil {
+		c.cause = err
+	}
+	c.lock.Unlock()
+	c.cancel()
+	return true
+}
+
+// Cause will return why the Context from Context was cancelled, such as
+// ErrInterrupted or ErrNumSamplesRead. If it was cancelled some other way
+// (such as by its CancelFunc), or doesn't come from Context, this is the
+// same as ctx.Err().
+func Cause(ctx context.Context) error {
+	err := ctx.Err()
+	c, ok := ctx.Value(cancelerKey{}).(*canceler)
+	if !ok {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cause != nil {
+		return c.cause
+	}
+	if errors.Is(err, context.DeadlineExceeded) && c.deadlineCause != nil {
+		return c.deadlineCause
+	}
+	return err
+}
+
+// ExitStatus will return the process exit code for why the Context from
+// Context ended, along with a one line summary of it. Running to the end of
+// --timeout, --stop-at or --num-samples, or being cancelled by the
+// CancelFunc, is ExitOK. Signals are 128 plus the signal number, as a shell
+// would report, and a stalled stream is ExitIOErr.
+func ExitStatus(ctx context.Context) (int, string) {
+	cause := Cause(ctx)
+	switch {
+	case cause == nil, errors.Is(cause, context.Canceled):
+		return ExitOK, "finished"
+	case errors.Is(cause, ErrTimeout):
+		return ExitCode(cause), "finished: ran for --timeout"
+	case errors.Is(cause, ErrStopAt):
+		return ExitCode(cause), "finished: ran until --stop-at"
+	case errors.Is(cause, ErrNumSamplesRead):
+		return ExitCode(cause), "finished: read --num-samples samples"
+	case errors.Is(cause, ErrInterrupted):
+		return ExitCode(cause), "interrupted by SIGINT"
+	case errors.Is(cause, ErrTerminated):
+		return ExitCode(cause), "terminated by SIGTERM"
+	case errors.Is(cause, ErrStreamStalled):
+		return ExitCode(cause), "failed: stream stalled"
+	default:
+		return ExitCode(cause), fmt.Sprintf("failed: %s", cause)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,66 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// closers is a stack of functions used to release everything that was set
+// up while loading an SDR (the device itself, any wrappers around it, and
+// any library state). Functions are run in reverse order of being pushed,
+// so the most recently acquired thing is released first.
+type closers struct {
+	lock sync.Mutex
+	fns  []func() error
+}
+
+// Push will add a function to the top of the stack.
+func (c *closers) Push(fn func() error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.fns = append(c.fns, fn)
+}
+
+// Close will run every function on the stack, most recent first. Every
+// function is run even if one fails, and the first error is returned.
+// Calling Close more than once is safe; later calls do nothing.
+func (c *closers) Close() error {
+	c.lock.Lock()
+	fns := c.fns
+	c.fns = nil
+	c.lock.Unlock()
+
+	var ret error
+	for i := len(fns) - 1; i >= 0; i-- {
+		if err := fns[i](); err != nil {
+			log.WithError(err).Warn("cli: error during cleanup")
+			if ret == nil {
+				ret = err
+			}
+		}
+	}
+	return ret
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,122 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// sdrCompletion is used internally to provide dynamic shell completion for
+// a flag registered by RegisterSDRFlagsWithPrefix. The prefix the flag was
+// registered with is passed along so that other flags (such as --sdr) can be
+// looked up.
+type sdrCompletion func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective)
+
+var (
+	allSdrCompletions = map[string]sdrCompletion{}
+	allSdrGainStages  = map[string][][2]string{}
+)
+
+// addSdrCompletion will register a completion function for the named flag,
+// without any prefix.
+func addSdrCompletion(name string, fn sdrCompletion) {
+	allSdrCompletions[name] = fn
+}
+
+// addSdrGainStages will register the names (and a short description) of the
+// gain stages of the named backend, for completing --gains. These are fixed
+// lists rather than asking the device, since completing a flag shouldn't go
+// and open the hardware.
+func addSdrGainStages(name string, stages ...[2]string) {
+	allSdrGainStages[name] = stages
+}
+
+func init() {
+	addSdrCompletion("sdr", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return allSdrNames(allSdrConstructors), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	addSdrCompletion("agc", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{
+			"on\tlet the device control gain",
+			"manual\tuse the gains set by --gains",
+		}, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	addSdrCompletion("frequency", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		ret := []string{}
+		for name, freq := range FrequencyAliases {
+			ret = append(ret, fmt.Sprintf("%s\t%s", name, freq))
+		}
+		sort.Strings(ret)
+		return ret, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	addSdrCompletion("gains", completeGains)
+}
+
+// completeGains will offer the names of the gain stages of the backend
+// selected by --sdr, as registered by addSdrGainStages. Since --gains is a
+// comma separated list, anything before the last comma is kept as-is.
+func completeGains(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+	backend, err := c.Flags().GetString(prefix + "sdr")
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	done := ""
+	if i := strings.LastIndex(toComplete, ","); i >= 0 {
+		done = toComplete[:i+1]
+	}
+
+	ret := []string{}
+	for _, stage := range allSdrGainStages[backend] {
+		ret = append(ret, fmt.Sprintf("%s%s=\t%s", done, stage[0], stage[1]))
+	}
+	return ret, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+}
+
+// registerSDRCompletions will register every known sdrCompletion against the
+// flags registered with the provided prefix.
+func registerSDRCompletions(c *cobra.Command, prefix string) {
+	for name, fn := range allSdrCompletions {
+		fn := fn
+		flagName := prefix + name
+		if c.Flags().Lookup(flagName) == nil {
+			continue
+		}
+		c.RegisterFlagCompletionFunc(flagName, func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return fn(cmd, prefix, toComplete)
+		})
+	}
+}
+
+// completeOnOff completes flags parsed by parseOnOff.
+func completeOnOff(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{"on", "off"}, cobra.ShellCompDirectiveNoFileComp
+}
+
+// vim: foldmethod=marker
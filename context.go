@@ -22,11 +22,12 @@ package cli
 
 import (
 	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
-	"sync"
 	"syscall"
 	"time"
 
@@ -34,6 +35,10 @@ import (
 	"github.com/spf13/pflag"
 )
 
+// defaultShutdownGrace is how long shutdown may take after C-c before the
+// stacks are dumped and the process exits, if --shutdown-grace isn't set.
+const defaultShutdownGrace = 3 * time.Second
+
 func printStack() {
 	os.Stderr.Write(stack())
 }
@@ -49,52 +54,209 @@ func stack() []byte {
 	}
 }
 
+// dumpStack will write the header (if there is one) and the goroutine stacks
+// to path, or to a timestamped file in the temp directory if path is empty,
+// and return where they went. The stacks are taken before the header is
+// worked out, so that they show where things were when the dump was asked
+// for.
+func dumpStack(path, reason string, header func() string) (string, error) {
+	stacks := stack()
+	if path == "" {
+		path = filepath.Join(os.TempDir(), fmt.Sprintf(
+			"%s-%s-%s.txt",
+			filepath.Base(os.Args[0]), reason, time.Now().Format("20060102T150405.000"),
+		))
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return path, err
+	}
+	defer f.Close()
+	if header != nil {
+		if _, err := f.WriteString(header()); err != nil {
+			return path, err
+		}
+	}
+	if _, err := f.Write(stacks); err != nil {
+		return path, err
+	}
+	return path, f.Close()
+}
+
 // Context will return a context.Context tied to CLI application. This will
 // use a --timeout flag, if set, and intercept C-c to cancel the context.
+//
+// --stop-at will cancel the context at that wall-clock time, and
+// WaitForStart will wait for --start-at.
+//
+// After C-c, shutdown has --shutdown-grace to finish before the goroutine
+// stacks are written to --hang-dump-path and the process exits. A second C-c
+// exits right away. Either way, hooks registered with OnShutdown are run
+// before exiting. They're also run by the returned CancelFunc.
+//
+// SIGHUP will re-read the SDR flags from --reload-env-file, and apply
+// frequency, gain and AGC changes to the SDRs opened with this context,
+// without reopening them. The environment isn't re-read, since it can't be
+// changed once the process has started.
+//
+// On systems that have them, SIGUSR1 will write the goroutine stacks, some
+// process stats, and how far along each stream read through --stall-timeout
+// or LimitReader is, to a file in the temp directory without exiting, and
+// SIGUSR2 will switch the log level between info and debug.
+//
+// Why the context was cancelled is kept, and can be read with Cause, or
+// turned into an exit code and summary with ExitStatus.
+//
+// If --start-at or --stop-at can't be parsed, the context is returned already
+// cancelled, with the *SDRError as its Cause.
+//
+// The context is also set on the cobra.Command, so that things like LoadSDR
+// can respect its deadline.
 func Context(cmd *cobra.Command) (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
+	var deadlineCause error
 
-	timeout, err := cmd.Flags().GetDuration("timeout")
+	flags := cmd.Flags()
+	timeout, err := flags.GetDuration("timeout")
 	if err != nil {
 		log.WithError(err).Warn("Internal Error: RegisterContextFlags was not called on the cobra.Command. Timeouts ignored.")
 	}
+	var deadline time.Time
 	if timeout != 0 {
-		ctx, cancel = context.WithTimeout(ctx, timeout)
+		deadline, deadlineCause = time.Now().Add(timeout), ErrTimeout
+	}
+
+	sched := parseSchedule(flags, time.Now())
+	if !sched.stop.IsZero() && (deadline.IsZero() || sched.stop.Before(deadline)) {
+		deadline, deadlineCause = sched.stop, ErrStopAt
 	}
 
-	c := make(chan os.Signal)
-	signal.Notify(
-		c,
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	ctx = context.WithValue(ctx, scheduleKey{}, sched)
+	ctx = context.WithValue(ctx, cancelerKey{}, &canceler{
+		cancel:        cancel,
+		deadlineCause: deadlineCause,
+	})
+	if sched.err != nil {
+		// Running without the capture window that was asked for isn't
+		// going to be what anyone wanted, so there's no running at all.
+		log.WithError(sched.err).Error("Bad capture window")
+		cancelWithCause(ctx, sched.err)
+	}
+
+	grace, err := flags.GetDuration("shutdown-grace")
+	if err != nil {
+		grace = defaultShutdownGrace
+	}
+	dumpPath, _ := flags.GetString("hang-dump-path")
+
+	reloadEnvFile, _ := flags.GetString("reload-env-file")
+
+	hooks := &shutdownHooks{}
+	reloader := &sdrReloader{envFile: reloadEnvFile}
+	streams := &streamRegistry{}
+	ctx = context.WithValue(ctx, shutdownHooksKey{}, hooks)
+	ctx = context.WithValue(ctx, sdrReloaderKey{}, reloader)
+	ctx = context.WithValue(ctx, streamRegistryKey{}, streams)
+	cmd.SetContext(ctx)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, append([]os.Signal{
 		os.Interrupt,
 		syscall.SIGTERM,
 		syscall.SIGINT,
-	)
-	once := sync.Once{}
+		syscall.SIGHUP,
+	}, diagnosticSignals...)...)
 	go func() {
+		// Stop catching signals once we're done with them, so this
+		// goroutine doesn't outlive the context.
+		defer signal.Stop(c)
+
+		shuttingDown := false
 		for {
-			sig := <-c
+			var sig os.Signal
+			select {
+			case sig = <-c:
+			case <-ctx.Done():
+				if !shuttingDown {
+					return
+				}
+				// Keep waiting on a second C-c.
+				sig = <-c
+			}
 
+			// Reloading and diagnostics talk to the SDRs, which may be
+			// wedged, so they're run off to the side to keep C-c working.
 			switch sig {
+			case syscall.SIGHUP:
+				log.Info("SIGHUP, reconfiguring SDRs")
+				go reloader.Reload()
 			case syscall.SIGTERM, syscall.SIGINT:
-				log.Info("C-c hit, requesting shutdown")
-				cancel()
-				go once.Do(func() {
-					time.Sleep(time.Second * 3)
-					log.Warn("Something hung our exit for 3 seconds. Dumping stack")
-					printStack()
-					os.Exit(1)
-				})
+				if shuttingDown {
+					log.Warn("C-c hit again, exiting now")
+					hooks.Run(forcedShutdownTimeout, true)
+					os.Exit(ExitFailure)
+				}
+				shuttingDown = true
+				log.Info("C-c hit, requesting shutdown (again to exit now)")
+				cause := ErrInterrupted
+				if sig == syscall.SIGTERM {
+					cause = ErrTerminated
+				}
+				cancelWithCause(ctx, cause)
+				go shutdownWatchdog(hooks, grace, dumpPath)
+			default:
+				go handleDiagnosticSignal(sig, reloader, streams)
 			}
 		}
 	}()
 
-	return ctx, cancel
+	return ctx, func() {
+		cancel()
+		hooks.Run(grace, false)
+	}
+}
+
+// shutdownWatchdog will exit the process if it's still around after grace,
+// leaving the goroutine stacks behind to figure out what hung, and giving
+// the shutdown hooks one last chance to run.
+func shutdownWatchdog(hooks *shutdownHooks, grace time.Duration, dumpPath string) {
+	time.Sleep(grace)
+
+	path, err := dumpStack(dumpPath, "hang", nil)
+	if err != nil {
+		log.WithError(err).Warn("Can't write the stack dump, writing it to stderr")
+		printStack()
+	} else {
+		log.WithField("path", path).Warnf("Something hung our exit for %s. Dumped stacks", grace)
+	}
+	hooks.Run(forcedShutdownTimeout, true)
+	os.Exit(ExitFailure)
+}
+
+// commandContext will return the context.Context set on the cobra.Command
+// (by Context, or cobra's ExecuteContext), or context.Background if there
+// isn't one.
+func commandContext(cmd *cobra.Command) context.Context {
+	if ctx := cmd.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
 }
 
-// RegisterContextFlags will register the --timeout flag for the context.
+// RegisterContextFlags will register the --timeout, capture window, sample
+// limit and shutdown flags for the context.
 func RegisterContextFlags(flags *pflag.FlagSet) {
-	flags.Bool("pprof", false, "enable pprof")
+	flags.Bool("pprof", false, "write pprof profiles to the temp dir (with RunSDR or NewApp)")
 	flags.Duration("timeout", time.Duration(0), "time to wait before requesting exit")
+	flags.String("start-at", "", "time to start capturing at (RFC3339, or HH:MM:SS local)")
+	flags.String("stop-at", "", "time to request exit at (RFC3339, or HH:MM:SS local)")
+	flags.String("num-samples", "", "samples to read before requesting exit (such as 2.4M, or 10s@rate)")
+	flags.Duration("shutdown-grace", defaultShutdownGrace, "time to let shutdown finish after C-c before exiting anyway")
+	flags.String("hang-dump-path", "", "file to write goroutine stacks to if shutdown hangs (default a file in the temp dir)")
+	flags.String("reload-env-file", "", "file of RF_* settings (as in the environment) to re-read on SIGHUP, which is the only place changes are picked up from")
 }
 
 // vim: foldmethod=marker
@@ -0,0 +1,80 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// sdrDeviceFlags will return the flags that select dev, such as
+// --sdr=pluto --pluto-uri=usb:1.5.5.
+func sdrDeviceFlags(dev SDRDevice) string {
+	names := []string{}
+	for name := range dev.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	flags := []string{fmt.Sprintf("--sdr=%s", dev.Backend)}
+	for _, name := range names {
+		flags = append(flags, fmt.Sprintf("--%s=%s", name, dev.Flags[name]))
+	}
+	return strings.Join(flags, " ")
+}
+
+func printDevices(cmd *cobra.Command, args []string) error {
+	devices := ListSDRDevices()
+	if len(devices) == 0 {
+		fmt.Printf("No SDRs found\n")
+		return nil
+	}
+
+	for _, dev := range devices {
+		fmt.Printf("%s\n", sdrDeviceFlags(dev))
+		fmt.Printf("  Manufacturer: %s\n", dev.Info.Manufacturer)
+		fmt.Printf("       Product: %s\n", dev.Info.Product)
+		fmt.Printf("        Serial: %s\n", dev.Info.Serial)
+		fmt.Printf("\n")
+	}
+	return nil
+}
+
+// RegisterDevicesSubcommand will register a command to the Cobra app that
+// lists the SDRs the compiled in backends can find, along with the flags
+// that will select each one.
+func RegisterDevicesSubcommand(rootCmd *cobra.Command) *cobra.Command {
+	devicesCmd := &cobra.Command{
+		Use:   "devices",
+		Short: "list attached SDRs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printDevices(cmd, args)
+		},
+	}
+
+	rootCmd.AddCommand(devicesCmd)
+	return devicesCmd
+}
+
+// vim: foldmethod=marker
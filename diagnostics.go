@@ -0,0 +1,108 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// processStart is roughly when the process started, for the uptime in
+// diagnostic dumps.
+var processStart = time.Now()
+
+// diagnostics will describe the process, the SDRs it has open, and the
+// streams being read from them, for the top of a diagnostic dump.
+func diagnostics(reloader *sdrReloader, streams *streamRegistry) string {
+	var (
+		b   strings.Builder
+		mem runtime.MemStats
+	)
+	runtime.ReadMemStats(&mem)
+
+	fmt.Fprintf(&b, "%s (pid %d)\n", strings.Join(os.Args, " "), os.Getpid())
+	fmt.Fprintf(&b, "\n")
+	fmt.Fprintf(&b, "          Time: %s\n", time.Now().Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "        Uptime: %s\n", time.Since(processStart).Round(time.Millisecond))
+	fmt.Fprintf(&b, "     Log Level: %s\n", log.GetLevel())
+	fmt.Fprintf(&b, "    Goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&b, "     Heap Used: %d bytes\n", mem.HeapAlloc)
+	fmt.Fprintf(&b, "   Memory (OS): %d bytes\n", mem.Sys)
+	fmt.Fprintf(&b, "           GCs: %d\n", mem.NumGC)
+	fmt.Fprintf(&b, "\n")
+
+	now := time.Now()
+	for _, s := range streams.snapshot() {
+		samples := s.samples.Load()
+		elapsed := now.Sub(s.start)
+		fmt.Fprintf(&b, "Stream %s:\n", s.name)
+		fmt.Fprintf(&b, "  Samples Read: %d\n", samples)
+		fmt.Fprintf(&b, "     Read Rate: %.0f sps (of %d sps), over %s\n",
+			float64(samples)/elapsed.Seconds(), s.rate, elapsed.Round(time.Millisecond))
+		if last := s.last.Load(); last != 0 {
+			lastTime := time.Unix(0, last)
+			fmt.Fprintf(&b, "   Last Sample: %s (%s ago)\n",
+				lastTime.Format(time.RFC3339Nano), now.Sub(lastTime).Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(&b, "   Last Sample: none yet\n")
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+
+	// Only the flag values are reported, rather than asking the devices,
+	// since a wedged device is one of the things this is for.
+	reloader.lock.Lock()
+	sdrs := append([]*reloadableSDR{}, reloader.sdrs...)
+	reloader.lock.Unlock()
+	for _, r := range sdrs {
+		fmt.Fprintf(&b, "SDR --%ssdr=%s:\n", r.prefix, r.backend)
+		values := r.snapshot()
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "  --%s%s: %s\n", r.prefix, name, values[name])
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+
+	return b.String()
+}
+
+// toggleDebug will switch the log level between info and debug.
+func toggleDebug() log.Level {
+	level := log.DebugLevel
+	if log.IsLevelEnabled(log.DebugLevel) {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+	return level
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,54 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+//go:build !windows
+
+package cli
+
+import (
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// diagnosticSignals are caught by Context in addition to the shutdown and
+// reload signals.
+var diagnosticSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
+
+// handleDiagnosticSignal will write a diagnostic dump on SIGUSR1, and toggle
+// debug logging on SIGUSR2.
+func handleDiagnosticSignal(sig os.Signal, reloader *sdrReloader, streams *streamRegistry) {
+	switch sig {
+	case syscall.SIGUSR1:
+		path, err := dumpStack("", "dump", func() string {
+			return diagnostics(reloader, streams)
+		})
+		if err != nil {
+			log.WithError(err).Warn("SIGUSR1: can't write the diagnostic dump")
+			return
+		}
+		log.WithField("path", path).Info("SIGUSR1: wrote diagnostic dump")
+	case syscall.SIGUSR2:
+		log.Infof("SIGUSR2: log level is now %s", toggleDebug())
+	}
+}
+
+// vim: foldmethod=marker
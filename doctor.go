@@ -0,0 +1,130 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	hzdebug "hz.tools/sdr/debug"
+)
+
+func doctor(cmd *cobra.Command, args []string) error {
+	bi := hzdebug.ReadBuildInfo()
+
+	fmt.Printf("Compiled drivers:\n")
+	fmt.Printf("\n")
+	for _, radioDriver := range bi.RadioDrivers {
+		fmt.Printf("    - %s\n", radioDriver)
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("SDR backends:\n")
+	fmt.Printf("\n")
+	for _, name := range allSdrNames(allSdrConstructors) {
+		if _, ok := allSdrDiscovery[name]; ok {
+			fmt.Printf("    - %s (can list devices)\n", name)
+			continue
+		}
+		fmt.Printf("    - %s\n", name)
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("Devices found:\n")
+	fmt.Printf("\n")
+	devices := ListSDRDevices()
+	for _, dev := range devices {
+		fmt.Printf("    - %s\n", sdrDeviceFlags(dev))
+	}
+	if len(devices) == 0 {
+		fmt.Printf("    (none)\n")
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("Environment:\n")
+	fmt.Printf("\n")
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "RF_") {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		fmt.Printf("    %s\n", kv)
+	}
+	if len(env) == 0 {
+		fmt.Printf("    (no RF_ variables set)\n")
+	}
+
+	fmt.Printf("\n")
+	if !cmd.Flags().Changed("sdr") && os.Getenv("RF_SDR") == "" {
+		fmt.Printf("Pass --sdr (and the flags for it) to try opening a device.\n")
+		fmt.Printf("\n")
+		return nil
+	}
+
+	dev, cfg, closer, err := OpenSDR(cmd)
+	if err != nil {
+		fmt.Printf("Opening the SDR failed (exit code %d):\n", ExitCode(err))
+		fmt.Printf("\n")
+		fmt.Printf("    %s\n", err)
+		fmt.Printf("\n")
+		return err
+	}
+	defer closer()
+
+	info := dev.HardwareInfo()
+	fmt.Printf("Opened the SDR:\n")
+	fmt.Printf("\n")
+	fmt.Printf("        Backend: %s\n", cfg.Backend)
+	fmt.Printf("   Manufacturer: %s\n", info.Manufacturer)
+	fmt.Printf("        Product: %s\n", info.Product)
+	fmt.Printf("         Serial: %s\n", info.Serial)
+	fmt.Printf("      Frequency: %s\n", cfg.Frequency)
+	fmt.Printf("    Sample Rate: %d\n", cfg.SampleRate)
+	fmt.Printf("\n")
+	return nil
+}
+
+// RegisterDoctorSubcommand will register a command to the Cobra app that
+// reports the compiled in drivers, the SDRs that can be found and the RF_
+// environment, and tries to open the SDR given by the flags, to help figure
+// out why a device won't open.
+func RegisterDoctorSubcommand(rootCmd *cobra.Command) *cobra.Command {
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "check the SDR setup",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return doctor(cmd, args)
+		},
+	}
+	RegisterSDRFlags(doctorCmd)
+
+	rootCmd.AddCommand(doctorCmd)
+	return doctorCmd
+}
+
+// vim: foldmethod=marker
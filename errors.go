@@ -0,0 +1,203 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"hz.tools/sdr"
+)
+
+var (
+	// ErrUnknownBackend is returned when the requested --sdr backend is not
+	// known, or was not compiled into this binary.
+	ErrUnknownBackend = fmt.Errorf("cli: unknown sdr backend")
+
+	// ErrDeviceNotFound is returned when the requested device is not
+	// attached to the system, or can't be found by the backend.
+	ErrDeviceNotFound = fmt.Errorf("cli: sdr device not found")
+
+	// ErrDeviceBusy is returned when the device exists, but is in use by
+	// another process.
+	ErrDeviceBusy = fmt.Errorf("cli: sdr device busy")
+
+	// ErrInvalidGain is returned when the --gains or --agc flags can't be
+	// parsed, or don't match the gain stages of the device.
+	ErrInvalidGain = fmt.Errorf("cli: invalid gain")
+
+	// ErrInvalidFlag is returned when an SDR flag can't be parsed, or
+	// conflicts with another flag.
+	ErrInvalidFlag = fmt.Errorf("cli: invalid sdr flag")
+
+	// ErrUnsupportedSetting is returned when a flag asks for something the
+	// selected device or driver can't do.
+	ErrUnsupportedSetting = fmt.Errorf("cli: setting not supported by sdr")
+
+	// ErrDriver is returned when the underlying driver fails while opening
+	// or configuring the device.
+	ErrDriver = fmt.Errorf("cli: sdr driver error")
+)
+
+// SDRError is returned by LoadSDR (and the backends it dispatches to) when
+// something goes wrong. Kind is one of the Err* sentinels above, and can be
+// checked with errors.Is. Err is the underlying cause, if any.
+type SDRError struct {
+	// Kind is the class of error, such as ErrDeviceNotFound.
+	Kind error
+
+	// Backend is the name of the backend (such as "rtl") that was being
+	// loaded, if known.
+	Backend string
+
+	// Err is the underlying error, which may be nil.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *SDRError) Error() string {
+	parts := []string{e.Kind.Error()}
+	if e.Backend != "" {
+		parts = append(parts, e.Backend)
+	}
+	if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+	return strings.Join(parts, ": ")
+}
+
+// Unwrap will return the underlying error.
+func (e *SDRError) Unwrap() error {
+	return e.Err
+}
+
+// Is will match the error against the Kind of the SDRError.
+func (e *SDRError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// newSDRError will wrap err as an SDRError of the provided kind. If err is
+// already an SDRError, it's returned as-is (with the Backend filled in if
+// it was missing).
+func newSDRError(kind error, backend string, err error) error {
+	var sdrErr *SDRError
+	if errors.As(err, &sdrErr) {
+		if sdrErr.Backend == "" {
+			sdrErr.Backend = backend
+		}
+		return sdrErr
+	}
+	return &SDRError{Kind: kind, Backend: backend, Err: err}
+}
+
+// driverError will wrap an error returned by an underlying driver call. An
+// sdr.ErrNotSupported becomes ErrUnsupportedSetting, everything else becomes
+// ErrDriver.
+func driverError(backend string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sdr.ErrNotSupported) {
+		return newSDRError(ErrUnsupportedSetting, backend, err)
+	}
+	return newSDRError(ErrDriver, backend, err)
+}
+
+// Process exit codes, taken from BSD's sysexits.h.
+const (
+	// ExitOK is returned when everything went fine.
+	ExitOK = 0
+
+	// ExitFailure is returned for errors we don't know how to classify.
+	ExitFailure = 1
+
+	// ExitUsage is returned when the command was used incorrectly.
+	ExitUsage = 64
+
+	// ExitDataErr is returned when user provided input data was bad.
+	ExitDataErr = 65
+
+	// ExitNoInput is returned when an input (such as a device) doesn't exist.
+	ExitNoInput = 66
+
+	// ExitUnavailable is returned when a required service is unavailable.
+	ExitUnavailable = 69
+
+	// ExitSoftware is returned for internal software errors.
+	ExitSoftware = 70
+
+	// ExitIOErr is returned when an I/O error happened with a device.
+	ExitIOErr = 74
+
+	// ExitTempFail is returned when trying again later may work.
+	ExitTempFail = 75
+
+	// ExitConfig is returned when something was configured incorrectly.
+	ExitConfig = 78
+
+	// ExitInterrupted is returned when stopped by SIGINT, as a shell would
+	// report it (128 plus the signal number).
+	ExitInterrupted = 130
+
+	// ExitTerminated is returned when stopped by SIGTERM, as a shell would
+	// report it.
+	ExitTerminated = 143
+)
+
+// ExitCode will return a sysexits style process exit code for the provided
+// error. A nil error returns ExitOK, and any error that isn't known returns
+// ExitFailure. Cancellation causes (see Cause) map the same way as they do
+// for ExitStatus.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrInvalidFlag):
+		return ExitUsage
+	case errors.Is(err, ErrInvalidGain):
+		return ExitDataErr
+	case errors.Is(err, ErrDeviceNotFound):
+		return ExitNoInput
+	case errors.Is(err, ErrUnknownBackend):
+		return ExitUnavailable
+	case errors.Is(err, ErrDriver):
+		return ExitIOErr
+	case errors.Is(err, ErrDeviceBusy):
+		return ExitTempFail
+	case errors.Is(err, ErrUnsupportedSetting):
+		return ExitConfig
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrStopAt), errors.Is(err, ErrNumSamplesRead):
+		return ExitOK
+	case errors.Is(err, ErrInterrupted):
+		return ExitInterrupted
+	case errors.Is(err, ErrTerminated):
+		return ExitTerminated
+	case errors.Is(err, ErrStreamStalled):
+		return ExitIOErr
+	case errors.Is(err, ErrInteractive):
+		return ExitUsage
+	default:
+		return ExitFailure
+	}
+}
+
+// vim: foldmethod=marker
@@ -40,7 +40,8 @@ func EnvRegister(prefix string, flagSet *pflag.FlagSet) {
 }
 
 // EnvRegisterWithOverrides will set the default values for all flags in the
-// FlagSet to values taken from the environment.
+// FlagSet to values taken from the environment. Flags set this way are
+// marked as Changed, just as if they had been passed on the command line.
 func EnvRegisterWithOverrides(prefix string, flagSet *pflag.FlagSet, overrides map[string]string) {
 	flagSet.VisitAll(func(flag *pflag.Flag) {
 		envName, ok := overrides[flag.Name]
@@ -52,8 +53,25 @@ func EnvRegisterWithOverrides(prefix string, flagSet *pflag.FlagSet, overrides m
 		if value == "" {
 			return
 		}
-		flag.Value.Set(value)
+		flagSet.Set(flag.Name, value)
 	})
 }
 
+// parseOnOff will parse a tri-state flag, where "" means to leave the
+// setting alone.
+func parseOnOff(backend, name, value string) (*bool, error) {
+	var ret bool
+	switch value {
+	case "":
+		return nil, nil
+	case "on", "true":
+		ret = true
+	case "off", "false":
+		ret = false
+	default:
+		return nil, newSDRError(ErrInvalidFlag, backend, fmt.Errorf("--%s must be on or off, not %q", name, value))
+	}
+	return &ret, nil
+}
+
 // vim: foldmethod=marker
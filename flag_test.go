@@ -0,0 +1,56 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestEnvRegister(t *testing.T) {
+	t.Setenv("RF_HACKRF_AMP", "true")
+	t.Setenv("RF_PLUTO_TX_ATTENUATION", "10.25")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Bool("hackrf-amp", false, "")
+	flags.Float64("pluto-tx-attenuation", 0, "")
+	flags.String("sdr", "", "")
+	EnvRegister("RF_", flags)
+
+	for _, name := range []string{"hackrf-amp", "pluto-tx-attenuation"} {
+		if !flags.Changed(name) {
+			t.Errorf("%s: set from the environment, but not marked as Changed", name)
+		}
+	}
+	if flags.Changed("sdr") {
+		t.Errorf("sdr: not in the environment, but marked as Changed")
+	}
+
+	if amp, err := flags.GetBool("hackrf-amp"); err != nil || !amp {
+		t.Errorf("hackrf-amp: got %t (%v), want true", amp, err)
+	}
+	if att, err := flags.GetFloat64("pluto-tx-attenuation"); err != nil || att != 10.25 {
+		t.Errorf("pluto-tx-attenuation: got %f (%v), want 10.25", att, err)
+	}
+}
+
+// vim: foldmethod=marker
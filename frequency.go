@@ -0,0 +1,75 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"strings"
+
+	"hz.tools/rf"
+)
+
+// FrequencyAliases are well known channel names that can be passed to
+// --frequency in place of a frequency. Programs are free to add their own
+// entries (ideally with AddFrequencyAlias) before flags are parsed. Names are
+// matched without regard to case.
+var FrequencyAliases = map[string]rf.Hz{
+	"adsb":    rf.MustParseHz("1090MHz"),
+	"uat":     rf.MustParseHz("978MHz"),
+	"ais1":    rf.MustParseHz("161.975MHz"),
+	"ais2":    rf.MustParseHz("162.025MHz"),
+	"acars":   rf.MustParseHz("131.55MHz"),
+	"aprs":    rf.MustParseHz("144.39MHz"),
+	"aprs-eu": rf.MustParseHz("144.8MHz"),
+	"ism433":  rf.MustParseHz("433.92MHz"),
+	"ism868":  rf.MustParseHz("868MHz"),
+	"ism915":  rf.MustParseHz("915MHz"),
+	"wx1":     rf.MustParseHz("162.55MHz"),
+	"wx2":     rf.MustParseHz("162.4MHz"),
+	"wx3":     rf.MustParseHz("162.475MHz"),
+	"wx4":     rf.MustParseHz("162.425MHz"),
+	"wx5":     rf.MustParseHz("162.45MHz"),
+	"wx6":     rf.MustParseHz("162.5MHz"),
+	"wx7":     rf.MustParseHz("162.525MHz"),
+}
+
+// ParseFrequency will parse a frequency passed on the command line. This
+// is either the name of an entry in FrequencyAliases, or anything that
+// rf.ParseHz understands.
+func ParseFrequency(freq string) (rf.Hz, error) {
+	if hz, ok := FrequencyAliases[strings.ToLower(freq)]; ok {
+		return hz, nil
+	}
+	// Entries put into the map directly may not be lower case.
+	for name, hz := range FrequencyAliases {
+		if strings.EqualFold(name, freq) {
+			return hz, nil
+		}
+	}
+	return rf.ParseHz(freq)
+}
+
+// AddFrequencyAlias will add a well known channel name to FrequencyAliases,
+// so that it may be passed to --frequency.
+func AddFrequencyAlias(name string, freq rf.Hz) {
+	FrequencyAliases[strings.ToLower(name)] = freq
+}
+
+// vim: foldmethod=marker
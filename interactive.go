@@ -34,7 +34,11 @@ func IsPty(f *os.File) bool {
 	return (fi.Mode() & os.ModeCharDevice) != 0
 }
 
-// WarnInteractive will os.Exit(1) if:
+// ErrInteractive is returned by CheckInteractive when it won't write to a
+// terminal.
+var ErrInteractive = fmt.Errorf("cli: refusing to write binary to a terminal without --im-a-weirdo")
+
+// CheckInteractive will return ErrInteractive if:
 //
 //  - the passed FD is a CharDevice
 //  - the --im-a-weirdo flag is false
@@ -42,13 +46,27 @@ func IsPty(f *os.File) bool {
 // This will return an error if RegisterInteractive is not called
 // on the cobra.Command.
 //
-func WarnInteractive(cmd *cobra.Command, f *os.File) error {
+func CheckInteractive(cmd *cobra.Command, f *os.File) error {
 	isWeird, err := cmd.Flags().GetBool("im-a-weirdo")
 	if err != nil {
 		return err
 	}
 
 	if IsPty(f) && !isWeird {
+		return ErrInteractive
+	}
+	return nil
+}
+
+// WarnInteractive will os.Exit with the ExitCode of ErrInteractive if
+// CheckInteractive returns it, after explaining why.
+//
+// This will return an error if RegisterInteractive is not called
+// on the cobra.Command.
+//
+func WarnInteractive(cmd *cobra.Command, f *os.File) error {
+	err := CheckInteractive(cmd, f)
+	if err == ErrInteractive {
 		fmt.Printf(`
 I'm cowardly refusing to write binary to your pretty
 terminal. It makes unpleasant glyphs and the terminal
@@ -57,9 +75,9 @@ beeps too. No one likes that. Except weirdos.
 If you're a weirdo, pass the --im-a-weirdo flag.
 
 `)
-		os.Exit(1)
+		os.Exit(ExitCode(ErrInteractive))
 	}
-	return nil
+	return err
 }
 
 // RegisterInteractiveFlags will register the --im-a-weirdo override for
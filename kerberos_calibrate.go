@@ -0,0 +1,86 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"hz.tools/sdr"
+)
+
+// coherentSdr is implemented by SDRs that can start a set of phase aligned
+// receivers, such as the kerberos-coherent backend.
+type coherentSdr interface {
+	StartCoherentRx() (sdr.ReadClosers, error)
+}
+
+func kerberosCalibrate(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	if flags.Lookup("kerberos-calibration") == nil {
+		return newSDRError(ErrUnknownBackend, "kerberos-coherent", nil)
+	}
+	if !flags.Changed("sdr") {
+		if err := flags.Set("sdr", "kerberos-coherent"); err != nil {
+			return err
+		}
+	}
+	if err := flags.Set("kerberos-calibration", "save"); err != nil {
+		return err
+	}
+
+	dev, cfg, closer, err := OpenSDR(cmd)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	coherent, ok := dev.(coherentSdr)
+	if !ok {
+		return newSDRError(ErrInvalidFlag, cfg.Backend, fmt.Errorf("backend can't be calibrated"))
+	}
+
+	rcs, err := coherent.StartCoherentRx()
+	if err != nil {
+		return driverError(cfg.Backend, err)
+	}
+	return rcs.Close()
+}
+
+// RegisterKerberosCalibrateSubcommand will register a command to the Cobra
+// app that calibrates a KerberosSDR against its noise source, and saves the
+// result for use with --kerberos-calibration=load.
+func RegisterKerberosCalibrateSubcommand(rootCmd *cobra.Command) *cobra.Command {
+	calibrateCmd := &cobra.Command{
+		Use:   "kerberos-calibrate",
+		Short: "save the KerberosSDR phase calibration",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return kerberosCalibrate(cmd, args)
+		},
+	}
+	RegisterSDRFlags(calibrateCmd)
+
+	rootCmd.AddCommand(calibrateCmd)
+	return calibrateCmd
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,143 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"hz.tools/sdr"
+)
+
+// loadedSdr wraps a device returned by LoadSDR, so that the caller's Close
+// releases everything openSDR set up, and takes the device out of the
+// SIGHUP and shutdown handling, rather than only closing the device.
+type loadedSdr struct {
+	sdr.Sdr
+
+	close func() error
+}
+
+// Close implements the sdr.Sdr interface.
+func (l *loadedSdr) Close() error {
+	return l.close()
+}
+
+// Unwrap will return the device as opened by the backend, to get at driver
+// specific types and methods. The caller should still Close the wrapper, not
+// the device returned here.
+func (l *loadedSdr) Unwrap() sdr.Sdr {
+	return l.Sdr
+}
+
+// loadedRx forwards StartRx to the wrapped sdr.Receiver.
+type loadedRx struct {
+	rx sdr.Receiver
+}
+
+// StartRx implements the sdr.Receiver interface.
+func (l loadedRx) StartRx() (sdr.ReadCloser, error) {
+	return l.rx.StartRx()
+}
+
+// loadedTx forwards StartTx to the wrapped sdr.Transmitter.
+type loadedTx struct {
+	tx sdr.Transmitter
+}
+
+// StartTx implements the sdr.Transmitter interface.
+func (l loadedTx) StartTx() (sdr.WriteCloser, error) {
+	return l.tx.StartTx()
+}
+
+// loadedCoherent forwards StartCoherentRx to the wrapped coherentSdr.
+type loadedCoherent struct {
+	coherent coherentSdr
+}
+
+// StartCoherentRx implements the coherentSdr interface.
+func (l loadedCoherent) StartCoherentRx() (sdr.ReadClosers, error) {
+	return l.coherent.StartCoherentRx()
+}
+
+type (
+	loadedReceiver struct {
+		*loadedSdr
+		loadedRx
+	}
+
+	loadedTransmitter struct {
+		*loadedSdr
+		loadedTx
+	}
+
+	loadedTransceiver struct {
+		*loadedSdr
+		loadedRx
+		loadedTx
+	}
+
+	loadedCoherentSdr struct {
+		*loadedSdr
+		loadedCoherent
+	}
+
+	loadedCoherentReceiver struct {
+		*loadedSdr
+		loadedRx
+		loadedCoherent
+	}
+
+	loadedCoherentTransceiver struct {
+		*loadedSdr
+		loadedRx
+		loadedTx
+		loadedCoherent
+	}
+)
+
+// wrapLoadedSdr will wrap dev so that Close calls closer instead. The
+// wrapper is an sdr.Receiver, sdr.Transmitter or coherentSdr if dev is. Any
+// other driver specific interfaces are hidden, but the device can be had
+// with Unwrap.
+func wrapLoadedSdr(dev sdr.Sdr, closer func() error) sdr.Sdr {
+	l := &loadedSdr{Sdr: dev, close: closer}
+
+	rx, isRx := dev.(sdr.Receiver)
+	tx, isTx := dev.(sdr.Transmitter)
+	coherent, isCoherent := dev.(coherentSdr)
+
+	switch {
+	case isRx && isTx && isCoherent:
+		return loadedCoherentTransceiver{l, loadedRx{rx}, loadedTx{tx}, loadedCoherent{coherent}}
+	case isRx && isCoherent:
+		return loadedCoherentReceiver{l, loadedRx{rx}, loadedCoherent{coherent}}
+	case isRx && isTx:
+		return loadedTransceiver{l, loadedRx{rx}, loadedTx{tx}}
+	case isRx:
+		return loadedReceiver{l, loadedRx{rx}}
+	case isTx:
+		return loadedTransmitter{l, loadedTx{tx}}
+	case isCoherent:
+		return loadedCoherentSdr{l, loadedCoherent{coherent}}
+	default:
+		return l
+	}
+}
+
+// vim: foldmethod=marker
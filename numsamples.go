@@ -0,0 +1,209 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"hz.tools/sdr"
+)
+
+// ParseNumSamples will parse a sample count, such as 1024, 2.4M or 10k, or
+// a length of time at a sample rate, such as 10s@2.4M. The rate may also be
+// "rate", to use the provided rate (usually the SDR's sample rate).
+func ParseNumSamples(value string, rate uint) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if i := strings.Index(value, "@"); i >= 0 {
+		duration, err := time.ParseDuration(value[:i])
+		if err != nil {
+			return 0, err
+		}
+		if duration < 0 {
+			return 0, fmt.Errorf("%q has a negative duration", value)
+		}
+		sps := new(big.Rat).SetUint64(uint64(rate))
+		if rateString := value[i+1:]; rateString != "rate" {
+			sps, err = parseSI(rateString)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if sps.Sign() <= 0 {
+			return 0, fmt.Errorf("%q needs a sample rate", value)
+		}
+		n := new(big.Rat).SetFrac64(int64(duration), int64(time.Second))
+		n.Mul(n, sps)
+		samples := roundRat(n)
+		if samples.Sign() == 0 {
+			return 0, fmt.Errorf("%q is less than one sample", value)
+		}
+		return ratToSamples(value, samples)
+	}
+
+	n, err := parseSI(value)
+	if err != nil {
+		return 0, err
+	}
+	if !n.IsInt() {
+		return 0, fmt.Errorf("%q is not a whole number of samples", value)
+	}
+	return ratToSamples(value, n.Num())
+}
+
+// ratToSamples will check that n fits in a uint64.
+func ratToSamples(value string, n *big.Int) (uint64, error) {
+	if !n.IsUint64() {
+		return 0, fmt.Errorf("%q is too many samples", value)
+	}
+	return n.Uint64(), nil
+}
+
+// roundRat will round a non-negative number to the nearest whole number,
+// with halves rounded up.
+func roundRat(n *big.Rat) *big.Int {
+	num := new(big.Int).Lsh(n.Num(), 1)
+	num.Add(num, n.Denom())
+	return num.Quo(num, new(big.Int).Lsh(n.Denom(), 1))
+}
+
+// siMultipliers are the suffixes parseSI takes.
+var siMultipliers = map[byte]int64{
+	'k': 1e3,
+	'K': 1e3,
+	'M': 1e6,
+	'G': 1e9,
+}
+
+// siNumber is the form of number parseSI takes, before the suffix. It's
+// checked before parsing, since big.Rat also takes fractions and 0x, 0b and
+// 0o prefixed numbers.
+var siNumber = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// parseSI will parse a non-negative decimal number with an optional k, M or
+// G suffix. It's parsed exactly, rather than as a float, so that something
+// like 1.001k is a whole number.
+func parseSI(value string) (*big.Rat, error) {
+	number := value
+	multiplier := int64(1)
+	if len(number) > 0 {
+		if m, ok := siMultipliers[number[len(number)-1]]; ok {
+			number, multiplier = number[:len(number)-1], m
+		}
+	}
+	if !siNumber.MatchString(number) {
+		return nil, fmt.Errorf("can't parse %q as a number", value)
+	}
+	n, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return nil, fmt.Errorf("can't parse %q as a number", value)
+	}
+	if n.Sign() < 0 {
+		return nil, fmt.Errorf("%q can't be negative", value)
+	}
+	return n.Mul(n, new(big.Rat).SetInt64(multiplier)), nil
+}
+
+// limitReader reads up to remaining samples, and then cancels the Context.
+type limitReader struct {
+	sdr.ReadCloser
+
+	lock      sync.Mutex
+	remaining uint64
+	done      func()
+
+	stats   *streamStats
+	untrack func()
+}
+
+// Read implements the sdr.Reader interface.
+func (lr *limitReader) Read(buf sdr.Samples) (int, error) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	if lr.remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint64(buf.Length()) > lr.remaining {
+		buf = buf.Slice(0, int(lr.remaining))
+	}
+	n, err := lr.ReadCloser.Read(buf)
+	lr.remaining -= uint64(n)
+	lr.stats.add(n)
+	if lr.remaining == 0 {
+		lr.done()
+	}
+	return n, err
+}
+
+// Close implements the sdr.Closer interface.
+func (lr *limitReader) Close() error {
+	lr.untrack()
+	return lr.ReadCloser.Close()
+}
+
+// LimitReader will wrap a reader from the SDR returned by LoadSDR (or
+// OpenSDR), so that it reads exactly --num-samples samples. Once they've
+// been read, it returns io.EOF, and the Context from Context is cancelled
+// with ErrNumSamplesRead as the Cause.
+//
+// If --num-samples isn't set, r is returned as-is.
+func LimitReader(c *cobra.Command, r sdr.ReadCloser) (sdr.ReadCloser, error) {
+	numSamples, err := c.Flags().GetString("num-samples")
+	if err != nil {
+		return nil, err
+	}
+	n, err := ParseNumSamples(numSamples, r.SampleRate())
+	if err != nil {
+		return nil, &SDRError{Kind: ErrInvalidFlag, Err: fmt.Errorf("--num-samples: %w", err)}
+	}
+	if n == 0 {
+		return r, nil
+	}
+
+	ctx := commandContext(c)
+	lr := &limitReader{
+		ReadCloser: r,
+		remaining:  n,
+		done: func() {
+			cancelWithCause(ctx, ErrNumSamplesRead)
+		},
+	}
+	if _, ok := r.(*stallReader); ok {
+		// Already counted by the stallReader.
+		lr.stats, lr.untrack = &streamStats{}, func() {}
+	} else {
+		lr.stats, lr.untrack = trackStream(ctx, "--num-samples", r.SampleRate())
+	}
+	return lr, nil
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,81 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"testing"
+)
+
+func TestParseNumSamples(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		rate  uint
+		want  uint64
+		err   bool
+	}{
+		{value: "", want: 0},
+		{value: "1024", want: 1024},
+		{value: "10k", want: 10000},
+		{value: "10K", want: 10000},
+		{value: "2.4M", want: 2400000},
+		{value: "1.001k", want: 1001},
+		{value: "1.001M", want: 1001000},
+		{value: "0.067G", want: 67000000},
+		{value: "1e3", want: 1000},
+		{value: ".5k", want: 500},
+		{value: "10s@2.4M", want: 24000000},
+		{value: "1ms@1.001M", want: 1001},
+		{value: "1.5s@rate", rate: 1000, want: 1500},
+		{value: "1.5", err: true},
+		{value: "1.0001k", err: true},
+		{value: "-1", err: true},
+		{value: "1/2", err: true},
+		{value: "k", err: true},
+		{value: "lots", err: true},
+		{value: "1e20", err: true},
+		{value: "1s@rate", err: true},
+		{value: "1s@0", err: true},
+		{value: "1ns@1.5", err: true},
+		{value: "-1s@1M", err: true},
+		{value: "0x10", err: true},
+		{value: "0b101", err: true},
+		{value: "0o17", err: true},
+		{value: "1_000", err: true},
+		{value: "1s@0x10", err: true},
+	} {
+		got, err := ParseNumSamples(test.value, test.rate)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseNumSamples(%q, %d) = %d, wanted an error", test.value, test.rate, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseNumSamples(%q, %d): %s", test.value, test.rate, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseNumSamples(%q, %d) = %d, wanted %d", test.value, test.rate, got, test.want)
+		}
+	}
+}
+
+// vim: foldmethod=marker
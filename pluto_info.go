@@ -0,0 +1,108 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// plutoInfo is what a Pluto says about itself.
+type plutoInfo struct {
+	URI         string
+	Model       string
+	Serial      string
+	Firmware    string
+	Temperature float64
+	RxChannels  int
+	TxChannels  int
+}
+
+var (
+	// plutoInfoByURI and plutoURIBySerial are set by the pluto backend, and
+	// left nil if it's not compiled in.
+	plutoInfoByURI   func(uri string) (*plutoInfo, error)
+	plutoURIBySerial func(serial string) (string, error)
+)
+
+func printPlutoInfo(cmd *cobra.Command, args []string) error {
+	if plutoInfoByURI == nil {
+		return newSDRError(ErrUnknownBackend, "pluto", nil)
+	}
+
+	uris := []string{}
+	for _, arg := range args {
+		if strings.Contains(arg, ":") {
+			uris = append(uris, arg)
+			continue
+		}
+		uri, err := plutoURIBySerial(arg)
+		if err != nil {
+			return err
+		}
+		uris = append(uris, uri)
+	}
+	if len(args) == 0 {
+		for _, dev := range ListSDRDevices() {
+			if dev.Backend == "pluto" {
+				uris = append(uris, dev.Flags["pluto-uri"])
+			}
+		}
+		if len(uris) == 0 {
+			return newSDRError(ErrDeviceNotFound, "pluto", fmt.Errorf("no plutos found"))
+		}
+	}
+
+	for _, uri := range uris {
+		info, err := plutoInfoByURI(uri)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", info.URI)
+		fmt.Printf("        Model: %s\n", info.Model)
+		fmt.Printf("       Serial: %s\n", info.Serial)
+		fmt.Printf("     Firmware: %s\n", info.Firmware)
+		fmt.Printf("  Temperature: %.1fC\n", info.Temperature)
+		fmt.Printf("     Channels: %dR%dT\n", info.RxChannels, info.TxChannels)
+		fmt.Printf("\n")
+	}
+	return nil
+}
+
+// RegisterPlutoInfoSubcommand will register a command to the Cobra app that
+// prints the firmware, serial, temperature and channels of each Pluto given
+// by URI or serial, or of every Pluto that can be found.
+func RegisterPlutoInfoSubcommand(rootCmd *cobra.Command) *cobra.Command {
+	infoCmd := &cobra.Command{
+		Use:   "pluto-info [uri|serial]...",
+		Short: "describe attached PlutoSDRs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printPlutoInfo(cmd, args)
+		},
+	}
+
+	rootCmd.AddCommand(infoCmd)
+	return infoCmd
+}
+
+// vim: foldmethod=marker
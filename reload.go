@@ -0,0 +1,308 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"hz.tools/sdr"
+)
+
+// reloadableFlags are the SDR flags (without a prefix) that SIGHUP looks at.
+// Changes to the ones that aren't live are rejected, since they'd need the
+// device to be reopened.
+var reloadableFlags = []struct {
+	name string
+	live bool
+}{
+	{"sdr", false},
+	{"sample-rate", false},
+	{"frequency", true},
+	{"agc", true},
+	{"gains", true},
+}
+
+// reloadableSDR is a device opened by OpenSDR (or LoadSDR) that SIGHUP can
+// reconfigure, along with the flag values it's currently set to. It's taken
+// out of the sdrReloader when the device is released.
+type reloadableSDR struct {
+	prefix  string
+	backend string
+	dev     sdr.Sdr
+	flags   *pflag.FlagSet
+
+	// applying is held while the device is being reconfigured, so that it
+	// isn't released part way through.
+	applying sync.Mutex
+	closed   bool
+
+	// lock guards values, and is never held across calls to the device.
+	lock   sync.Mutex
+	values map[string]string
+}
+
+// value will return the current value of the (unprefixed) flag.
+func (r *reloadableSDR) value(name string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.values[name]
+}
+
+// snapshot will return a copy of the current flag values.
+func (r *reloadableSDR) snapshot() map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := make(map[string]string, len(r.values))
+	for name, value := range r.values {
+		ret[name] = value
+	}
+	return ret
+}
+
+// setValue will record that the (unprefixed) flag was changed by SIGHUP.
+func (r *reloadableSDR) setValue(name, value string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.values[name] = value
+}
+
+// sdrReloader is the set of devices to reconfigure on SIGHUP.
+type sdrReloader struct {
+	lock    sync.Mutex
+	sdrs    []*reloadableSDR
+	envFile string
+}
+
+type sdrReloaderKey struct{}
+
+// registerReloadableSDR will add the device to the Context's SIGHUP handling,
+// if there is any, and push its removal onto cleanup.
+func registerReloadableSDR(c *cobra.Command, prefix, backend string, dev sdr.Sdr, cleanup *closers) {
+	reloader, ok := commandContext(c).Value(sdrReloaderKey{}).(*sdrReloader)
+	if !ok {
+		return
+	}
+
+	flags := c.Flags()
+	r := &reloadableSDR{
+		prefix:  prefix,
+		backend: backend,
+		dev:     dev,
+		flags:   flags,
+		values:  map[string]string{},
+	}
+	for _, f := range reloadableFlags {
+		if flag := flags.Lookup(prefix + f.name); flag != nil {
+			r.values[f.name] = flag.Value.String()
+		}
+	}
+
+	reloader.lock.Lock()
+	reloader.sdrs = append(reloader.sdrs, r)
+	reloader.lock.Unlock()
+
+	cleanup.Push(func() error {
+		reloader.lock.Lock()
+		for i, other := range reloader.sdrs {
+			if other == r {
+				reloader.sdrs = append(reloader.sdrs[:i], reloader.sdrs[i+1:]...)
+				break
+			}
+		}
+		reloader.lock.Unlock()
+
+		// Wait for a SIGHUP that's part way through with this device.
+		r.applying.Lock()
+		r.closed = true
+		r.applying.Unlock()
+		return nil
+	})
+}
+
+// find will return the device registered for the flags and prefix, or nil.
+func (s *sdrReloader) find(flags *pflag.FlagSet, prefix string) *reloadableSDR {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range s.sdrs {
+		if r.flags == flags && r.prefix == prefix {
+			return r
+		}
+	}
+	return nil
+}
+
+// sdrFlagString will return the value of the (unprefixed) SDR flag, as
+// changed by SIGHUP if it has been. The flags themselves are left alone by
+// SIGHUP, so anything that reopens the device (such as after a stall) needs
+// to read the reloadable flags this way to keep the change.
+func sdrFlagString(c *cobra.Command, prefix, name string) (string, error) {
+	if reloader, ok := commandContext(c).Value(sdrReloaderKey{}).(*sdrReloader); ok {
+		if r := reloader.find(c.Flags(), prefix); r != nil {
+			return r.value(name), nil
+		}
+	}
+	return c.Flags().GetString(prefix + name)
+}
+
+// readEnvFile will read a file of KEY=VALUE lines, as would be put in the
+// environment. Blank lines and lines starting with # are skipped.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		ret[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+	}
+	return ret, scanner.Err()
+}
+
+// Reload will re-read the SDR flags from the --reload-env-file, and apply
+// what changed to each device. The process environment isn't re-read, since
+// it can't be changed from outside once the process has started.
+func (s *sdrReloader) Reload() {
+	if s.envFile == "" {
+		log.Warn("SIGHUP: --reload-env-file isn't set, nothing to re-read")
+		return
+	}
+	file, err := readEnvFile(s.envFile)
+	if err != nil {
+		log.WithError(err).Warn("SIGHUP: can't read the reload file, nothing changed")
+		return
+	}
+
+	// The devices are called without the lock held, so that one that's
+	// slow to answer doesn't hold up releasing the others.
+	s.lock.Lock()
+	sdrs := append([]*reloadableSDR{}, s.sdrs...)
+	s.lock.Unlock()
+	if len(sdrs) == 0 {
+		log.Info("SIGHUP: no SDRs to reconfigure")
+		return
+	}
+	for _, r := range sdrs {
+		if err := r.reload(file); err != nil {
+			log.WithError(err).WithField("sdr.prefix", r.prefix).Warn("SIGHUP: SDR not reconfigured")
+		}
+	}
+}
+
+// reload will work out the new flag values, and apply them to the device.
+func (r *reloadableSDR) reload(file map[string]string) error {
+	r.applying.Lock()
+	defer r.applying.Unlock()
+	if r.closed {
+		return nil
+	}
+
+	current := r.snapshot()
+	values := map[string]string{}
+	changed := log.Fields{}
+	needsReopen := []string{}
+
+	for _, f := range reloadableFlags {
+		flag := r.flags.Lookup(r.prefix + f.name)
+		if flag == nil {
+			continue
+		}
+		value := current[f.name]
+		if fileValue, ok := file[createEnvName("RF_", flag)]; ok {
+			value = fileValue
+		}
+		values[f.name] = value
+
+		if value == current[f.name] {
+			continue
+		}
+		changed[r.prefix+f.name] = value
+		if !f.live {
+			needsReopen = append(needsReopen, fmt.Sprintf("--%s%s", r.prefix, f.name))
+		}
+	}
+
+	if len(changed) == 0 {
+		log.WithField("sdr.prefix", r.prefix).Info("SIGHUP: nothing changed")
+		return nil
+	}
+	if len(needsReopen) != 0 {
+		return newSDRError(ErrUnsupportedSetting, r.backend, fmt.Errorf(
+			"%s can't be changed without a restart", strings.Join(needsReopen, ", "),
+		))
+	}
+
+	if values["agc"] != current["agc"] {
+		if err := setAGC(r.dev, r.backend, values["agc"]); err != nil {
+			return err
+		}
+		r.setValue("agc", values["agc"])
+	}
+
+	if values["gains"] != current["gains"] {
+		gainsMap, err := CreateGainMap(values["gains"])
+		if err != nil {
+			return newSDRError(ErrInvalidGain, r.backend, err)
+		}
+		if gainsMap != nil {
+			if err := sdr.SetGainStages(r.dev, gainsMap); err != nil {
+				return newSDRError(ErrInvalidGain, r.backend, err)
+			}
+		}
+		r.setValue("gains", values["gains"])
+	}
+
+	if values["frequency"] != current["frequency"] && values["frequency"] != "" {
+		frequency, err := ParseFrequency(values["frequency"])
+		if err != nil {
+			return newSDRError(ErrInvalidFlag, r.backend, err)
+		}
+		if err := r.dev.SetCenterFrequency(frequency); err != nil {
+			return driverError(r.backend, err)
+		}
+		r.setValue("frequency", values["frequency"])
+	}
+
+	log.WithFields(changed).Info("SIGHUP: SDR reconfigured")
+	return nil
+}
+
+// vim: foldmethod=marker
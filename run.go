@@ -0,0 +1,162 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"hz.tools/sdr"
+)
+
+// RegisterRunSDRFlags will register everything RunSDR needs on the
+// cobra.Command: the context flags (including --pprof), the SDR flags, and
+// the --im-a-weirdo override for the check on its output.
+func RegisterRunSDRFlags(cmd *cobra.Command) {
+	RegisterContextFlags(cmd.Flags())
+	RegisterSDRFlags(cmd)
+	RegisterInteractiveFlags(cmd)
+}
+
+// pprofName will return the name Pprof should use for the cobra.Command's
+// program, such as RFCAP for rfcap.
+func pprofName(cmd *cobra.Command) string {
+	return strings.ToUpper(strings.Replace(cmd.Root().Name(), "-", "_", -1))
+}
+
+// pprofFromFlags will start profiling as Pprof does. If --pprof is set and
+// the RF_%s_PPROF envvar isn't, the profiles are written to the temp
+// directory.
+func pprofFromFlags(cmd *cobra.Command) func() {
+	name := pprofName(cmd)
+	if os.Getenv(fmt.Sprintf("RF_%s_PPROF", name)) != "" {
+		return Pprof(name)
+	}
+
+	enabled, _ := cmd.Flags().GetBool("pprof")
+	if !enabled {
+		return func() {}
+	}
+
+	path := filepath.Join(os.TempDir(), fmt.Sprintf(
+		"%s-pprof-%s", cmd.Root().Name(), time.Now().Format("20060102T150405"),
+	))
+	cpuCloser, err := PprofCPU(fmt.Sprintf("%s.cpu", path))
+	if err != nil {
+		log.WithError(err).Warn("cli.Pprof: error profiling CPU")
+		return func() {}
+	}
+	allCloser, _ := PprofAll(path)
+	log.WithField("path", path).Info("cli.Pprof: writing profiles")
+	return func() {
+		allCloser()
+		cpuCloser()
+	}
+}
+
+// RunSDR will take care of everything around running a command that uses an
+// SDR, in order:
+//
+//   - refuse to write to out if it's a terminal (see CheckInteractive)
+//   - start profiling, if --pprof is set
+//   - set up the Context
+//   - open the SDR from the flags, and wait for --start-at
+//   - call run
+//   - close the SDR, and run the OnShutdown hooks
+//   - stop profiling
+//
+// Then, if something went wrong, the process exits with the matching code:
+// the ExitStatus of the Context once it's done (C-c, --stall-timeout and so
+// on), or the ExitCode of the error otherwise. A clean run (which includes
+// running out --timeout, --stop-at or --num-samples) returns.
+//
+// out is where run writes IQ to, such as os.Stdout, or nil if it doesn't
+// write to a file.
+//
+// The flags come from RegisterRunSDRFlags. This is meant to be called from
+// the cobra.Command's Run.
+func RunSDR(cmd *cobra.Command, out *os.File, run func(ctx context.Context, dev sdr.Sdr, cfg Config) error) {
+	exitWith(runSDR(cmd, out, run))
+}
+
+// exitWith will log how the command went, and exit if it didn't go well.
+func exitWith(code int, summary string, err error) {
+	switch {
+	case err != nil:
+		log.WithError(err).Error(summary)
+	case code != ExitOK:
+		log.Warn(summary)
+	default:
+		log.Info(summary)
+	}
+	if code != ExitOK {
+		os.Exit(code)
+	}
+}
+
+// runSDR is RunSDR, returning the exit code, a summary, and the error if
+// the command failed for something other than the Context ending.
+func runSDR(cmd *cobra.Command, out *os.File, run func(context.Context, sdr.Sdr, Config) error) (int, string, error) {
+	if out != nil {
+		if err := CheckInteractive(cmd, out); err != nil {
+			return ExitCode(err), "Not writing to the terminal", err
+		}
+	}
+
+	defer pprofFromFlags(cmd)()
+
+	ctx, cancel := Context(cmd)
+	defer cancel()
+
+	dev, cfg, closeDev, err := OpenSDR(cmd)
+	if err != nil {
+		return ExitCode(err), "Can't open the SDR", err
+	}
+	defer closeDev()
+
+	if err = WaitForStart(ctx); err == nil {
+		err = run(ctx, dev, cfg)
+	}
+	return runStatus(ctx, err)
+}
+
+// runStatus will work out how the command went from the error it returned
+// and the Context. This needs to be called before the Context's CancelFunc,
+// or every Cause is the CancelFunc.
+func runStatus(ctx context.Context, err error) (int, string, error) {
+	if ctx.Err() != nil {
+		code, summary := ExitStatus(ctx)
+		return code, summary, nil
+	}
+	if err != nil {
+		return ExitCode(err), "failed", err
+	}
+	return ExitOK, "finished", nil
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,141 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// wallClockLayout is the local time of day accepted by --start-at and
+// --stop-at, in addition to RFC3339.
+const wallClockLayout = "15:04:05"
+
+// schedule is the capture window from --start-at and --stop-at, stored in
+// the Context by Context.
+type schedule struct {
+	start time.Time
+	stop  time.Time
+	err   error
+}
+
+type scheduleKey struct{}
+
+// parseWallClock will parse an RFC3339 time, or a local HH:MM:SS time of day,
+// which is taken to be the next time that time of day comes around after
+// after.
+func parseWallClock(value string, after time.Time) (time.Time, error) {
+	if when, err := time.Parse(time.RFC3339, value); err == nil {
+		return when, nil
+	}
+	tod, err := time.ParseInLocation(wallClockLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC3339 nor HH:MM:SS", value)
+	}
+	after = after.In(time.Local)
+	when := time.Date(
+		after.Year(), after.Month(), after.Day(),
+		tod.Hour(), tod.Minute(), tod.Second(), 0, time.Local,
+	)
+	if !when.After(after) {
+		when = when.AddDate(0, 0, 1)
+	}
+	return when, nil
+}
+
+// parseSchedule will read --start-at and --stop-at. A --stop-at time of day
+// is the next one after the start, so a window can run past midnight.
+func parseSchedule(flags *pflag.FlagSet, now time.Time) schedule {
+	var sched schedule
+	startAt, _ := flags.GetString("start-at")
+	stopAt, _ := flags.GetString("stop-at")
+
+	if startAt != "" {
+		start, err := parseWallClock(startAt, now)
+		if err != nil {
+			sched.err = &SDRError{Kind: ErrInvalidFlag, Err: fmt.Errorf("--start-at: %w", err)}
+			return sched
+		}
+		sched.start = start
+	}
+
+	if stopAt != "" {
+		after := now
+		if sched.start.After(now) {
+			after = sched.start
+		}
+		stop, err := parseWallClock(stopAt, after)
+		if err != nil {
+			sched.err = &SDRError{Kind: ErrInvalidFlag, Err: fmt.Errorf("--stop-at: %w", err)}
+			return sched
+		}
+		if !stop.After(after) {
+			sched.err = &SDRError{Kind: ErrInvalidFlag, Err: fmt.Errorf(
+				"--stop-at %s is not after %s", stop.Format(time.RFC3339), after.Format(time.RFC3339),
+			)}
+			return sched
+		}
+		sched.stop = stop
+	}
+
+	return sched
+}
+
+// StartTime will return the time set by --start-at, or the zero time if
+// there isn't one.
+func StartTime(ctx context.Context) time.Time {
+	sched, _ := ctx.Value(scheduleKey{}).(schedule)
+	return sched.start
+}
+
+// WaitForStart will block until the time set by --start-at, returning early
+// if the Context is done. This lets a tool open and configure the SDR ahead
+// of time, and begin reading right on time.
+//
+// If --start-at or --stop-at couldn't be parsed, that error is returned.
+// Without --start-at, this returns right away.
+func WaitForStart(ctx context.Context) error {
+	sched, _ := ctx.Value(scheduleKey{}).(schedule)
+	if sched.err != nil {
+		return sched.err
+	}
+	if sched.start.IsZero() {
+		return ctx.Err()
+	}
+	return sleepContext(ctx, time.Until(sched.start))
+}
+
+// sleepContext will sleep for d, or until the Context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// vim: foldmethod=marker
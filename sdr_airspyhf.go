@@ -23,6 +23,9 @@
 package cli
 
 import (
+	"fmt"
+	"strconv"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
@@ -35,20 +38,30 @@ func init() {
 	addSdr(
 		"airspyhf",
 		func(flags *pflag.FlagSet, prefix string) {
-			flags.Uint64(prefix+"airspy-serial", 0, "device serial to use")
-			flags.Bool(prefix+"airspy-dsp", false, "Enable or disable Airspy DSP")
+			flags.String(prefix+"airspy-serial", "", "device serial to use, in hex (0x...) or decimal")
+			flags.String(prefix+"airspy-dsp", "", "[on|off] Airspy DSP, left as-is if unset")
+			flags.Lookup(prefix + "airspy-dsp").NoOptDefVal = "on"
+			flags.String(prefix+"airspy-lna", "", "[on|off] HF LNA (preamp), left as-is if unset")
 		},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
 			flags := c.Flags()
-			serial, err := flags.GetUint64(prefix + "airspy-serial")
+			serialString, err := flags.GetString(prefix + "airspy-serial")
+			if err != nil {
+				return nil, err
+			}
+			serial, err := parseAirspyhfSerial(serialString)
 			if err != nil {
 				return nil, err
 			}
 
-			setDsp, err := flags.GetBool(prefix + "airspy-dsp")
+			opts, err := parseAirspyhfOptions(flags, prefix)
 			if err != nil {
 				return nil, err
 			}
+			if err := airspyhfFindSerial(serial); err != nil {
+				return nil, err
+			}
+
 			var dev *airspyhf.Sdr
 			if serial == 0 {
 				dev, err = airspyhf.Open()
@@ -56,16 +69,126 @@ func init() {
 				dev, err = airspyhf.OpenBySerial(serial)
 			}
 			if err != nil {
-				return nil, err
+				return nil, newSDRError(ErrDriver, "airspyhf", err)
 			}
+			cleanup.Push(dev.Close)
 
-			if err := dev.SetDSP(setDsp); err != nil {
+			if err := opts.Apply(dev); err != nil {
 				return nil, err
 			}
-
 			return dev, nil
 		},
 	)
+
+	addSdrCompletion("airspy-serial", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		ret := []string{}
+		for _, serial := range airspyhf.ListSerials() {
+			ret = append(ret, fmt.Sprintf("0x%016X", serial))
+		}
+		return ret, cobra.ShellCompDirectiveNoFileComp
+	})
+	addSdrCompletion("airspy-dsp", completeOnOff)
+	addSdrCompletion("airspy-lna", completeOnOff)
+
+	addSdrGainStages(
+		"airspyhf",
+		[2]string{"Att", "attenuator, only 0 dB can be set"},
+		[2]string{"Amp", "LNA, 0 or 6 dB"},
+	)
+}
+
+const (
+	// airspyhfLNAGain is the gain of the "Amp" stage when the LNA is on.
+	airspyhfLNAGain = 6
+)
+
+// parseAirspyhfSerial will parse a serial as printed by airspyhf_info
+// (0x3652...), or as a plain decimal number. An empty string is 0, which
+// will match any device.
+func parseAirspyhfSerial(serial string) (uint64, error) {
+	if serial == "" {
+		return 0, nil
+	}
+	ret, err := strconv.ParseUint(serial, 0, 64)
+	if err != nil {
+		return 0, newSDRError(ErrInvalidFlag, "airspyhf", fmt.Errorf("can't parse serial %q", serial))
+	}
+	return ret, nil
+}
+
+// airspyhfOptions are the --airspy-* settings. nil values leave the device
+// setting unchanged.
+type airspyhfOptions struct {
+	DSP *bool
+	LNA *bool
+}
+
+// parseAirspyhfOptions will parse and check the --airspy-* flags.
+func parseAirspyhfOptions(flags *pflag.FlagSet, prefix string) (airspyhfOptions, error) {
+	var (
+		opts airspyhfOptions
+		err  error
+	)
+
+	dsp, err := flags.GetString(prefix + "airspy-dsp")
+	if err != nil {
+		return opts, err
+	}
+	if opts.DSP, err = parseOnOff("airspyhf", prefix+"airspy-dsp", dsp); err != nil {
+		return opts, err
+	}
+
+	lna, err := flags.GetString(prefix + "airspy-lna")
+	if err != nil {
+		return opts, err
+	}
+	if opts.LNA, err = parseOnOff("airspyhf", prefix+"airspy-lna", lna); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// Apply will set the options on the device. The LNA is set through the
+// "Amp" gain stage of hz.tools/sdr/airspyhf. There's no flag for the HF
+// attenuator, since the "Att" stage of the pinned driver can only set 0 dB
+// (it passes -6 dB and below to the library as a wrapped around uint8).
+func (opts airspyhfOptions) Apply(dev *airspyhf.Sdr) error {
+	if opts.DSP != nil {
+		if err := dev.SetDSP(*opts.DSP); err != nil {
+			return driverError("airspyhf", err)
+		}
+	}
+
+	gains := map[string]float32{}
+	if opts.LNA != nil {
+		gains["Amp"] = 0
+		if *opts.LNA {
+			gains["Amp"] = airspyhfLNAGain
+		}
+	}
+	if err := sdr.SetGainStages(dev, gains); err != nil {
+		return driverError("airspyhf", err)
+	}
+	return nil
+}
+
+// airspyhfFindSerial will check that an Airspy HF+ with the provided serial
+// is attached. A serial of 0 will match any device.
+func airspyhfFindSerial(serial uint64) error {
+	serials := airspyhf.ListSerials()
+	if len(serials) == 0 {
+		return newSDRError(ErrDeviceNotFound, "airspyhf", fmt.Errorf("no airspyhf devices found"))
+	}
+	if serial == 0 {
+		return nil
+	}
+	for _, sn := range serials {
+		if sn == serial {
+			return nil
+		}
+	}
+	return newSDRError(ErrDeviceNotFound, "airspyhf", fmt.Errorf("no device with serial %x found", serial))
 }
 
 // vim: foldmethod=marker
@@ -23,6 +23,9 @@
 package cli
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
@@ -34,18 +37,110 @@ import (
 func init() {
 	addSdr(
 		"hackrf",
-		func(flags *pflag.FlagSet, prefix string) {},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
-			if err := hackrf.Init(); err != nil {
-				return nil, err
+		func(flags *pflag.FlagSet, prefix string) {
+			flags.Bool(prefix+"hackrf-amp", false, "enable the RF amplifier")
+		},
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
+			exit, err := hackrfInit()
+			if err != nil {
+				return nil, newSDRError(ErrDriver, "hackrf", err)
 			}
+			cleanup.Push(exit)
+
+			devices, err := hackrf.List()
+			if err != nil {
+				return nil, newSDRError(ErrDriver, "hackrf", err)
+			}
+			if len(devices) == 0 {
+				return nil, newSDRError(ErrDeviceNotFound, "hackrf", fmt.Errorf("no hackrf devices found"))
+			}
+			// hz.tools/sdr/hackrf only has Open, which takes the first
+			// device, so there's no way to pick one by serial or index.
+			// Antenna power, the baseband filter and the clocks aren't
+			// exposed either, which leaves --hackrf-amp.
 			dev, err := hackrf.Open()
 			if err != nil {
+				return nil, newSDRError(ErrDriver, "hackrf", err)
+			}
+			cleanup.Push(dev.Close)
+
+			if err := applyHackrfOptions(c.Flags(), prefix, dev); err != nil {
 				return nil, err
 			}
 			return dev, nil
 		},
 	)
+
+	addSdrGainStages(
+		"hackrf",
+		[2]string{"Amp", "RF amplifier, 0 or 14 dB"},
+		[2]string{"RXIF", "Rx IF (LNA) gain, 0 to 40 dB"},
+		[2]string{"RXVGA", "Rx baseband gain, 0 to 62 dB"},
+		[2]string{"TXVGA", "Tx baseband gain, 0 to 47 dB"},
+	)
+}
+
+// hackrfLibrary tracks how many devices are using libhackrf, since more than
+// one prefix (such as rx- and tx-) may open a hackrf in the same process.
+var hackrfLibrary struct {
+	lock sync.Mutex
+	refs int
+}
+
+// hackrfInit will call hackrf.Init if nobody else has, and return a function
+// that will call hackrf.Exit once the last user is done with the library.
+func hackrfInit() (func() error, error) {
+	hackrfLibrary.lock.Lock()
+	defer hackrfLibrary.lock.Unlock()
+
+	if hackrfLibrary.refs == 0 {
+		if err := hackrf.Init(); err != nil {
+			return nil, err
+		}
+	}
+	hackrfLibrary.refs++
+
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() {
+			hackrfLibrary.lock.Lock()
+			defer hackrfLibrary.lock.Unlock()
+			hackrfLibrary.refs--
+			if hackrfLibrary.refs == 0 {
+				err = hackrf.Exit()
+			}
+		})
+		return err
+	}, nil
+}
+
+// applyHackrfOptions will apply the --hackrf-* settings that were set. The
+// amp is switched through its gain stage, since hz.tools/sdr/hackrf doesn't
+// have a setter for it.
+func applyHackrfOptions(flags *pflag.FlagSet, prefix string, dev *hackrf.Sdr) error {
+	if flags.Changed(prefix + "hackrf-amp") {
+		amp, err := flags.GetBool(prefix + "hackrf-amp")
+		if err != nil {
+			return err
+		}
+		stages, err := dev.GetGainStages()
+		if err != nil {
+			return driverError("hackrf", err)
+		}
+		ampStage := stages.First(sdr.GainStageTypeAmp)
+		if ampStage == nil {
+			return newSDRError(ErrUnsupportedSetting, "hackrf", fmt.Errorf("no amp gain stage"))
+		}
+		gain := ampStage.Range()[0]
+		if amp {
+			gain = ampStage.Range()[1]
+		}
+		if err := dev.SetGain(ampStage, gain); err != nil {
+			return driverError("hackrf", err)
+		}
+	}
+	return nil
 }
 
 // vim: foldmethod=marker
@@ -0,0 +1,296 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// sdrPrefixAnnotation is set on every flag registered by
+	// RegisterSDRFlagsWithPrefix, and holds the prefix it was registered
+	// with.
+	sdrPrefixAnnotation = "hz.tools/cli:sdr-prefix"
+
+	// sdrBackendAnnotation is set on flags that only apply to some backends,
+	// and holds the names of those backends.
+	sdrBackendAnnotation = "hz.tools/cli:sdr-backend"
+
+	// sdrLocalFlagsTemplate is the chunk of the default cobra usage template
+	// that renders local flags. It's swapped out for sdrFlagsTemplate, which
+	// renders the SDR flags in their own sections.
+	sdrLocalFlagsTemplate = `{{.LocalFlags.FlagUsages | trimTrailingWhitespaces}}{{end}}`
+
+	sdrFlagsTemplate = `{{(nonSDRFlags .LocalFlags).FlagUsages | trimTrailingWhitespaces}}{{end}}{{range sdrFlagGroups .LocalFlags}}
+
+{{.Title}}:
+{{.Flags.FlagUsages | trimTrailingWhitespaces}}{{end}}`
+)
+
+func init() {
+	cobra.AddTemplateFuncs(map[string]interface{}{
+		"nonSDRFlags":   nonSDRFlags,
+		"sdrFlagGroups": sdrFlagGroups,
+	})
+}
+
+// sdrFlagGroup is a heading, and the flags that belong under it, used when
+// rendering --help output.
+type sdrFlagGroup struct {
+	Title string
+	Flags *pflag.FlagSet
+}
+
+// annotateSDRFlags will mark every flag in the FlagSet as belonging to the
+// provided prefix and backend. An empty backend marks flags that apply to
+// every backend.
+func annotateSDRFlags(flags *pflag.FlagSet, prefix, backend string) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		flags.SetAnnotation(flag.Name, sdrPrefixAnnotation, []string{prefix})
+		if backend != "" {
+			flags.SetAnnotation(flag.Name, sdrBackendAnnotation, []string{backend})
+		}
+	})
+}
+
+// addSDRBackendFlags will add the flags registered by a backend to the
+// FlagSet. If a flag of the same name was already added by another backend
+// (such as the flags shared between the kerberos backends), the backend is
+// added to that flag's annotation instead.
+func addSDRBackendFlags(flags, backendFlags *pflag.FlagSet, backend string) {
+	backendFlags.VisitAll(func(flag *pflag.Flag) {
+		existing := flags.Lookup(flag.Name)
+		if existing == nil {
+			flags.AddFlag(flag)
+			return
+		}
+		backends := append(existing.Annotations[sdrBackendAnnotation], backend)
+		sort.Strings(backends)
+		flags.SetAnnotation(flag.Name, sdrBackendAnnotation, backends)
+	})
+}
+
+// flagBackends will return the backends a flag belongs to, or nil if it
+// applies to all of them.
+func flagBackends(flag *pflag.Flag) []string {
+	return flag.Annotations[sdrBackendAnnotation]
+}
+
+// flagHasBackend will check if the flag belongs to the named backend.
+func flagHasBackend(flag *pflag.Flag, backend string) bool {
+	for _, name := range flagBackends(flag) {
+		if name == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// flagAnnotation returns the first value of the named annotation, and if the
+// annotation was set at all.
+func flagAnnotation(flag *pflag.Flag, name string) (string, bool) {
+	values, ok := flag.Annotations[name]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// nonSDRFlags will return a FlagSet with every flag that was not registered
+// by RegisterSDRFlagsWithPrefix.
+func nonSDRFlags(flags *pflag.FlagSet) *pflag.FlagSet {
+	ret := pflag.NewFlagSet("", pflag.ContinueOnError)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if _, ok := flagAnnotation(flag, sdrPrefixAnnotation); ok {
+			return
+		}
+		ret.AddFlag(flag)
+	})
+	return ret
+}
+
+// sdrBackendFlags will return a FlagSet with every flag that belongs to the
+// named backend, across all prefixes.
+func sdrBackendFlags(flags *pflag.FlagSet, backend string) *pflag.FlagSet {
+	ret := pflag.NewFlagSet("", pflag.ContinueOnError)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flagHasBackend(flag, backend) {
+			ret.AddFlag(flag)
+		}
+	})
+	return ret
+}
+
+// sdrFlagGroups will return the SDR flags, grouped by backend. Flags that
+// apply to every backend come first, followed by each backend in order.
+func sdrFlagGroups(flags *pflag.FlagSet) []sdrFlagGroup {
+	common := pflag.NewFlagSet("", pflag.ContinueOnError)
+	backends := map[string]*pflag.FlagSet{}
+
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Hidden {
+			return
+		}
+		if _, ok := flagAnnotation(flag, sdrPrefixAnnotation); !ok {
+			return
+		}
+		names := flagBackends(flag)
+		if len(names) == 0 {
+			common.AddFlag(flag)
+			return
+		}
+		backend := strings.Join(names, ", ")
+		if _, ok := backends[backend]; !ok {
+			backends[backend] = pflag.NewFlagSet("", pflag.ContinueOnError)
+		}
+		backends[backend].AddFlag(flag)
+	})
+
+	ret := []sdrFlagGroup{}
+	if common.HasFlags() {
+		ret = append(ret, sdrFlagGroup{Title: "SDR Flags", Flags: common})
+	}
+
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ret = append(ret, sdrFlagGroup{
+			Title: fmt.Sprintf("SDR Flags (%s)", name),
+			Flags: backends[name],
+		})
+	}
+	return ret
+}
+
+// checkSDRBackendFlags will return an error if any flag that belongs to a
+// backend other than the selected one was explicitly set for the provided
+// prefix. Values taken from the environment are not checked, since those
+// are usually set once for every backend a user has.
+func checkSDRBackendFlags(flags *pflag.FlagSet, prefix, backend string) error {
+	var err error
+	flags.Visit(func(flag *pflag.Flag) {
+		if err != nil {
+			return
+		}
+		flagPrefix, ok := flagAnnotation(flag, sdrPrefixAnnotation)
+		if !ok || flagPrefix != prefix {
+			return
+		}
+		flagBackends := flagBackends(flag)
+		if len(flagBackends) == 0 || flagHasBackend(flag, backend) {
+			return
+		}
+		err = newSDRError(ErrInvalidFlag, backend, fmt.Errorf(
+			"--%s only applies to --%ssdr=%s",
+			flag.Name, prefix, strings.Join(flagBackends, "|"),
+		))
+	})
+	return err
+}
+
+// sdrHelpValue is the value of --help-sdr. Setting it also sets --help, so
+// cobra shows the help (by way of the HelpFunc set by registerSDRHelp)
+// before any of the command's hooks run, and returns nil from Execute.
+type sdrHelpValue struct {
+	cmd     *cobra.Command
+	backend string
+}
+
+// String implements the pflag.Value interface.
+func (v *sdrHelpValue) String() string {
+	return v.backend
+}
+
+// Type implements the pflag.Value interface.
+func (v *sdrHelpValue) Type() string {
+	return "string"
+}
+
+// Set implements the pflag.Value interface.
+func (v *sdrHelpValue) Set(backend string) error {
+	if _, ok := allSdrConstructors[backend]; !ok {
+		return newSDRError(ErrUnknownBackend, backend, nil)
+	}
+	v.backend = backend
+	if v.cmd.Flags().Lookup("help") == nil {
+		return nil
+	}
+	return v.cmd.Flags().Set("help", "true")
+}
+
+// registerSDRHelp will register the --help-sdr flag, and set up the usage
+// template to group SDR flags by backend. This is safe to call more than
+// once on the same cobra.Command.
+func registerSDRHelp(c *cobra.Command) {
+	if c.Flags().Lookup("help-sdr") != nil {
+		return
+	}
+
+	c.Flags().Var(&sdrHelpValue{cmd: c}, "help-sdr", fmt.Sprintf(
+		"show the flags for only one SDR backend [%s]",
+		strings.Join(allSdrNames(allSdrConstructors), "|"),
+	))
+	c.RegisterFlagCompletionFunc("help-sdr", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return allSdrNames(allSdrConstructors), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	if tmpl := c.UsageTemplate(); strings.Contains(tmpl, sdrLocalFlagsTemplate) {
+		c.SetUsageTemplate(strings.Replace(tmpl, sdrLocalFlagsTemplate, sdrFlagsTemplate, 1))
+	}
+
+	helpFunc := c.HelpFunc()
+	c.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		backend, _ := cmd.Flags().GetString("help-sdr")
+		if backend == "" {
+			helpFunc(cmd, args)
+			return
+		}
+		printSDRHelp(cmd, backend)
+	})
+}
+
+// printSDRHelp will write the flags for the named backend to the command's
+// output.
+func printSDRHelp(c *cobra.Command, backend string) error {
+	if _, ok := allSdrConstructors[backend]; !ok {
+		return newSDRError(ErrUnknownBackend, backend, nil)
+	}
+
+	out := c.OutOrStdout()
+	flags := sdrBackendFlags(c.Flags(), backend)
+	if !flags.HasFlags() {
+		fmt.Fprintf(out, "The %s backend has no flags.\n", backend)
+		return nil
+	}
+	fmt.Fprintf(out, "SDR Flags (%s):\n", backend)
+	fmt.Fprint(out, flags.FlagUsages())
+	return nil
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,600 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+//go:build !sdr.nortl
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"hz.tools/fftw"
+	"hz.tools/rf"
+	"hz.tools/sdr"
+	"hz.tools/sdr/rtl"
+	"hz.tools/sdr/rtl/kerberos"
+	"hz.tools/sdr/stream"
+)
+
+func init() {
+	addSdr(
+		"kerberos-coherent",
+		func(flags *pflag.FlagSet, prefix string) {
+			addKerberosFlags(flags, prefix)
+			flags.String(prefix+"kerberos-calibration", "", "[load|save|auto] reuse the phase calibration from --kerberos-calibration-file instead of calibrating on every start")
+			flags.String(prefix+"kerberos-calibration-file", defaultKerberosCalibrationFile(), "file to load and save KerberosSDR phase calibrations")
+		},
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
+			flags := c.Flags()
+			idxs, channels, err := kerberosDeviceIndexes(flags, prefix, "kerberos-coherent")
+			if err != nil {
+				return nil, err
+			}
+			mode, err := flags.GetString(prefix + "kerberos-calibration")
+			if err != nil {
+				return nil, err
+			}
+			path, err := flags.GetString(prefix + "kerberos-calibration-file")
+			if err != nil {
+				return nil, err
+			}
+			switch mode {
+			case "":
+			case "load", "save", "auto":
+				if path == "" {
+					return nil, newSDRError(ErrInvalidFlag, "kerberos-coherent", fmt.Errorf("--%skerberos-calibration-file must be set", prefix))
+				}
+			default:
+				return nil, newSDRError(ErrInvalidFlag, "kerberos-coherent", fmt.Errorf("unknown calibration mode: %s", mode))
+			}
+
+			dev, err := kerberos.NewCoherent(fftw.Plan, idxs[0], idxs[1], idxs[2], idxs[3], 0)
+			if err != nil {
+				return nil, rtlOpenError("kerberos-coherent", err)
+			}
+			cleanup.Push(dev.Close)
+			if mode == "" && channels == kerberosChannelsInOrder {
+				return dev, nil
+			}
+
+			k := &kerberosCoherentSdr{CoherentSdr: dev, channels: channels, mode: mode, path: path}
+			if mode == "load" {
+				// Fail early, rather than once the caller gets around to
+				// starting the Rx.
+				if _, err := k.loadCalibration(); err != nil {
+					return nil, err
+				}
+			}
+			return k, nil
+		},
+	)
+
+	addSdr(
+		"kerberos-offset",
+		func(flags *pflag.FlagSet, prefix string) {
+			addKerberosFlags(flags, prefix)
+			flags.StringSlice(prefix+"kerberos-offsets", nil, "frequency offset to add to each of the 4 tuners, in channel order (such as 0,-1.2kHz,0,0)")
+		},
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
+			flags := c.Flags()
+			idxs, channels, err := kerberosDeviceIndexes(flags, prefix, "kerberos-offset")
+			if err != nil {
+				return nil, err
+			}
+			offsets, err := kerberosOffsets(flags, prefix)
+			if err != nil {
+				return nil, err
+			}
+			dev, err := kerberos.NewOffset(fftw.Plan, idxs[0], idxs[1], idxs[2], idxs[3], 0)
+			if err != nil {
+				return nil, rtlOpenError("kerberos-offset", err)
+			}
+			cleanup.Push(dev.Close)
+			if offsets == [4]rf.Hz{} {
+				return dev, nil
+			}
+
+			// The offsets are given in channel order, but the OffsetSdr
+			// holds the tuners in device order.
+			var deviceOffsets [4]rf.Hz
+			for channel, offset := range offsets {
+				deviceOffsets[channels[channel]] = offset
+			}
+			return &kerberosOffsetSdr{OffsetSdr: dev, offsets: deviceOffsets}, nil
+		},
+	)
+
+	addSdrGainStages(
+		"kerberos-coherent",
+		[2]string{"Tuner", "tuner gain"},
+	)
+
+	addSdrGainStages(
+		"kerberos-offset",
+		[2]string{"Tuner", "tuner gain"},
+	)
+}
+
+// addKerberosFlags will register the flags shared by both kerberos backends.
+func addKerberosFlags(flags *pflag.FlagSet, prefix string) {
+	flags.UintSlice(prefix+"kerberos-indexes", []uint{0, 1, 2, 3}, "rtl device indexes of the 4 KerberosSDR tuners")
+	flags.StringSlice(prefix+"kerberos-serials", nil, "rtl serial numbers of the 4 KerberosSDR tuners, instead of indexes")
+	flags.Uint(prefix+"kerberos-reference", 0, "channel (0-3) to use as the phase and time reference")
+}
+
+// kerberosChannelsInOrder is the channel mapping when the reference is
+// channel 0, and the device order is the channel order.
+var kerberosChannelsInOrder = [4]int{0, 1, 2, 3}
+
+// kerberosDeviceIndexes will return the rtl device indexes of the 4 tuners
+// to open, after checking that they're distinct and plugged in. The reference
+// channel is moved to the front, since hz.tools/sdr/rtl/kerberos aligns
+// everything to the first device, so the position of each channel (in the
+// order given by --kerberos-indexes or --kerberos-serials) in the device
+// order is returned as well, to put things back in channel order.
+func kerberosDeviceIndexes(flags *pflag.FlagSet, prefix, backend string) ([4]uint, [4]int, error) {
+	var (
+		ret      [4]uint
+		channels [4]int
+	)
+
+	idxs, err := flags.GetUintSlice(prefix + "kerberos-indexes")
+	if err != nil {
+		return ret, channels, err
+	}
+	serials, err := flags.GetStringSlice(prefix + "kerberos-serials")
+	if err != nil {
+		return ret, channels, err
+	}
+	reference, err := flags.GetUint(prefix + "kerberos-reference")
+	if err != nil {
+		return ret, channels, err
+	}
+
+	if len(serials) != 0 {
+		if flags.Changed(prefix + "kerberos-indexes") {
+			return ret, channels, newSDRError(ErrInvalidFlag, backend, fmt.Errorf("can't set both serials and indexes"))
+		}
+		idxs = make([]uint, len(serials))
+		for i, serial := range serials {
+			idxs[i], err = rtl.DeviceIndexBySerial(serial)
+			if err != nil {
+				return ret, channels, newSDRError(ErrDeviceNotFound, backend, fmt.Errorf("serial %s: %w", serial, err))
+			}
+		}
+	}
+
+	if len(idxs) != len(ret) {
+		return ret, channels, newSDRError(ErrInvalidFlag, backend, fmt.Errorf("need exactly %d devices, got %d", len(ret), len(idxs)))
+	}
+	if reference >= uint(len(ret)) {
+		return ret, channels, newSDRError(ErrInvalidFlag, backend, fmt.Errorf("reference channel %d isn't between 0 and %d", reference, len(ret)-1))
+	}
+
+	rtlCount := rtl.DeviceCount()
+	seen := map[uint]bool{}
+	for _, idx := range idxs {
+		if seen[idx] {
+			return ret, channels, newSDRError(ErrInvalidFlag, backend, fmt.Errorf("device index %d is used more than once", idx))
+		}
+		seen[idx] = true
+		if idx >= rtlCount {
+			return ret, channels, newSDRError(ErrDeviceNotFound, backend, fmt.Errorf("device index %d isn't present (%d rtl devices found)", idx, rtlCount))
+		}
+	}
+
+	ret[0] = idxs[reference]
+	channels[reference] = 0
+	n := 1
+	for i, idx := range idxs {
+		if uint(i) == reference {
+			continue
+		}
+		ret[n] = idx
+		channels[i] = n
+		n++
+	}
+
+	log.WithFields(log.Fields{
+		"kerberos.devices":   ret,
+		"kerberos.channels":  channels,
+		"kerberos.reference": reference,
+	}).Debug("KerberosSDR device order")
+	return ret, channels, nil
+}
+
+// kerberosOffsets will parse the --kerberos-offsets flag.
+func kerberosOffsets(flags *pflag.FlagSet, prefix string) ([4]rf.Hz, error) {
+	var ret [4]rf.Hz
+
+	offsets, err := flags.GetStringSlice(prefix + "kerberos-offsets")
+	if err != nil {
+		return ret, err
+	}
+	if len(offsets) == 0 {
+		return ret, nil
+	}
+	if len(offsets) != len(ret) {
+		return ret, newSDRError(ErrInvalidFlag, "kerberos-offset", fmt.Errorf("need exactly %d offsets, got %d", len(ret), len(offsets)))
+	}
+	for i, offset := range offsets {
+		ret[i], err = rf.ParseHz(offset)
+		if err != nil {
+			return ret, newSDRError(ErrInvalidFlag, "kerberos-offset", err)
+		}
+	}
+	return ret, nil
+}
+
+// kerberosOffsetSdr wraps a kerberos.OffsetSdr, and nudges each tuner by a
+// fixed offset after the OffsetSdr lays out the adjacent bands.
+type kerberosOffsetSdr struct {
+	*kerberos.OffsetSdr
+
+	offsets    [4]rf.Hz
+	centerFreq rf.Hz
+}
+
+// SetCenterFrequency implements the sdr.Sdr interface.
+func (k *kerberosOffsetSdr) SetCenterFrequency(freq rf.Hz) error {
+	if err := k.OffsetSdr.SetCenterFrequency(freq); err != nil {
+		return err
+	}
+	k.centerFreq = freq
+
+	for i, dev := range k.Sdr {
+		if k.offsets[i] == 0 {
+			continue
+		}
+		tunerFreq, err := dev.GetCenterFrequency()
+		if err != nil {
+			return err
+		}
+		if err := dev.SetCenterFrequency(tunerFreq + k.offsets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSampleRate implements the sdr.Sdr interface. The OffsetSdr re-centers
+// the tuners when the sample rate changes, so the offsets are re-applied.
+func (k *kerberosOffsetSdr) SetSampleRate(sps uint) error {
+	if err := k.OffsetSdr.SetSampleRate(sps); err != nil {
+		return err
+	}
+	if k.centerFreq == 0 {
+		return nil
+	}
+	return k.SetCenterFrequency(k.centerFreq)
+}
+
+// defaultKerberosCalibrationFile will return the default path of the
+// calibration file, or an empty string if there's no config directory.
+func defaultKerberosCalibrationFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hz.tools", "kerberos-calibration.json")
+}
+
+// kerberosCalibration is the phase calibration of a set of 4 tuners, as
+// measured against the noise source by the first tuner.
+type kerberosCalibration struct {
+	Serials    [4]string  `json:"serials"`
+	Frequency  rf.Hz      `json:"frequency"`
+	SampleRate uint       `json:"sample_rate"`
+	Delays     [4]int     `json:"delays"`
+	Phases     [4]float64 `json:"phases"`
+	Created    time.Time  `json:"created"`
+}
+
+// kerberosCalibrations is the on-disk format of the calibration file, keyed
+// by the comma separated serials of the 4 tuners, in device order (that is,
+// with the reference first).
+type kerberosCalibrations map[string]kerberosCalibration
+
+// readKerberosCalibrations will read the calibration file at path. A missing
+// file is treated as an empty one.
+func readKerberosCalibrations(path string) (kerberosCalibrations, error) {
+	ret := kerberosCalibrations{}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ret, nil
+}
+
+// writeKerberosCalibrations will replace the calibration file at path.
+func writeKerberosCalibrations(path string, cals kerberosCalibrations) error {
+	b, err := json.MarshalIndent(cals, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// kerberosCoherentSdr wraps a kerberos.CoherentSdr to return the readers in
+// channel order rather than device order, and to load or save the phase
+// calibration done by StartCoherentRx, as set by --kerberos-calibration.
+type kerberosCoherentSdr struct {
+	*kerberos.CoherentSdr
+
+	channels [4]int
+	mode     string
+	path     string
+}
+
+// serials will return the serials of the 4 tuners, in device order.
+func (k *kerberosCoherentSdr) serials() [4]string {
+	var ret [4]string
+	for i, dev := range k.Sdr {
+		ret[i] = dev.HardwareInfo().Serial
+	}
+	return ret
+}
+
+// loadCalibration will return the saved calibration for these tuners.
+func (k *kerberosCoherentSdr) loadCalibration() (kerberosCalibration, error) {
+	serials := k.serials()
+	cals, err := readKerberosCalibrations(k.path)
+	if err != nil {
+		return kerberosCalibration{}, newSDRError(ErrInvalidFlag, "kerberos-coherent", err)
+	}
+	cal, ok := cals[strings.Join(serials[:], ",")]
+	if !ok {
+		return cal, newSDRError(ErrInvalidFlag, "kerberos-coherent", fmt.Errorf(
+			"no calibration for serials %s in %s", strings.Join(serials[:], ","), k.path,
+		))
+	}
+	return cal, nil
+}
+
+// saveCalibration will add the calibration to the calibration file,
+// replacing any old one for these tuners.
+func (k *kerberosCoherentSdr) saveCalibration(cal kerberosCalibration) error {
+	cals, err := readKerberosCalibrations(k.path)
+	if err != nil {
+		return err
+	}
+	cals[strings.Join(cal.Serials[:], ",")] = cal
+	if err := writeKerberosCalibrations(k.path, cals); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"kerberos.calibration.file":   k.path,
+		"kerberos.calibration.delays": cal.Delays,
+		"kerberos.calibration.phases": cal.Phases,
+	}).Info("KerberosSDR calibration saved")
+	return nil
+}
+
+// StartCoherentRx will start all the tuners, and return a reader for each,
+// in the channel order given by --kerberos-indexes or --kerberos-serials.
+func (k *kerberosCoherentSdr) StartCoherentRx() (sdr.ReadClosers, error) {
+	var (
+		rcs sdr.ReadClosers
+		err error
+	)
+	if k.mode == "" {
+		rcs, err = k.CoherentSdr.StartCoherentRx()
+	} else {
+		rcs, err = k.startCalibrationRx()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(sdr.ReadClosers, len(rcs))
+	for channel, i := range k.channels {
+		ret[channel] = rcs[i]
+	}
+	return ret, nil
+}
+
+// startCalibrationRx will start all the tuners, and either replay the saved
+// calibration, or calibrate against the noise source and save the result,
+// depending on the calibration mode. The readers are in device order.
+func (k *kerberosCoherentSdr) startCalibrationRx() (sdr.ReadClosers, error) {
+	freq, err := k.GetCenterFrequency()
+	if err != nil {
+		return nil, err
+	}
+	sps, err := k.GetSampleRate()
+	if err != nil {
+		return nil, err
+	}
+
+	if k.mode == "load" || k.mode == "auto" {
+		cal, err := k.loadCalibration()
+		switch {
+		case err == nil && cal.Frequency == freq && cal.SampleRate == sps:
+			return k.startCalibratedRx(cal)
+		case k.mode == "load" && err != nil:
+			return nil, err
+		case k.mode == "load":
+			return nil, newSDRError(ErrInvalidFlag, "kerberos-coherent", fmt.Errorf(
+				"calibration in %s is for %s at %d sps, not %s at %d sps",
+				k.path, cal.Frequency, cal.SampleRate, freq, sps,
+			))
+		}
+		log.WithError(err).Info("No usable KerberosSDR calibration, calibrating")
+	}
+
+	rcs, cal, err := k.calibrate()
+	if err != nil {
+		return nil, err
+	}
+	cal.Frequency = freq
+	cal.SampleRate = sps
+	if err := k.saveCalibration(cal); err != nil {
+		rcs.Close()
+		return nil, err
+	}
+	return rcs, nil
+}
+
+// startCalibratedRx will start all the tuners, and line them up using a
+// saved calibration rather than the noise source.
+func (k *kerberosCoherentSdr) startCalibratedRx(cal kerberosCalibration) (sdr.ReadClosers, error) {
+	ret := make(sdr.ReadClosers, 0, len(k.Sdr))
+	for i, dev := range k.Sdr {
+		rc, err := dev.StartRx()
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+		ret = append(ret, rc)
+
+		if cal.Delays[i] > 0 {
+			buf, err := sdr.MakeSamples(rc.SampleFormat(), cal.Delays[i])
+			if err != nil {
+				ret.Close()
+				return nil, err
+			}
+			if _, err := sdr.ReadFull(rc, buf); err != nil {
+				ret.Close()
+				return nil, err
+			}
+		}
+	}
+
+	for i := range ret {
+		r, err := stream.Multiply(ret[i], complex64(cmplx.Rect(1, cal.Phases[i])))
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+		ret[i] = sdr.ReaderWithCloser(r, ret[i].Close)
+	}
+
+	log.WithFields(log.Fields{
+		"kerberos.calibration.file":    k.path,
+		"kerberos.calibration.created": cal.Created,
+	}).Info("KerberosSDR calibration loaded")
+	return ret, nil
+}
+
+// calibrate does what kerberos.CoherentSdr.StartCoherentRx does, but counts
+// the samples each tuner dropped while lining up, so that the delays can be
+// replayed later on.
+func (k *kerberosCoherentSdr) calibrate() (sdr.ReadClosers, kerberosCalibration, error) {
+	cal := kerberosCalibration{
+		Serials: k.serials(),
+		Created: time.Now(),
+	}
+
+	if err := k.SetAutomaticGain(true); err != nil {
+		return nil, cal, err
+	}
+	if err := k.SetBiasT(true); err != nil {
+		return nil, cal, err
+	}
+
+	var (
+		counters = make([]*countingReadCloser, len(k.Sdr))
+		ret      = make(kerberos.CoherentReadCloser, 0, len(k.Sdr))
+	)
+	for i, dev := range k.Sdr {
+		rc, err := dev.StartRx()
+		if err != nil {
+			ret.Close()
+			return nil, cal, err
+		}
+		counters[i] = &countingReadCloser{ReadCloser: rc}
+		ret = append(ret, counters[i])
+	}
+
+	rotations, err := ret.Sync(fftw.Plan)
+	if err != nil {
+		ret.Close()
+		return nil, cal, err
+	}
+
+	least := counters[0].n
+	for _, counter := range counters {
+		if counter.n < least {
+			least = counter.n
+		}
+	}
+	for i := range ret {
+		cal.Delays[i] = counters[i].n - least
+		cal.Phases[i] = cmplx.Phase(complex128(rotations[i]))
+
+		r, err := stream.Multiply(ret[i], rotations[i])
+		if err != nil {
+			ret.Close()
+			return nil, cal, err
+		}
+		ret[i] = sdr.ReaderWithCloser(r, ret[i].Close)
+	}
+
+	go func() {
+		// Same as the kerberos package; the Rx needs to be consumed for
+		// this to go through.
+		if err := k.SetBiasT(false); err != nil {
+			ret.Close()
+		}
+	}()
+
+	return sdr.ReadClosers(ret), cal, nil
+}
+
+// countingReadCloser counts the samples read through it.
+type countingReadCloser struct {
+	sdr.ReadCloser
+	n int
+}
+
+// Read implements the sdr.Reader interface.
+func (c *countingReadCloser) Read(s sdr.Samples) (int, error) {
+	n, err := c.ReadCloser.Read(s)
+	c.n += n
+	return n, err
+}
+
+// vim: foldmethod=marker
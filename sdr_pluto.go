@@ -23,11 +23,16 @@
 package cli
 
 import (
+	"fmt"
+	"math"
+	"strings"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"hz.tools/sdr"
 	"hz.tools/sdr/pluto"
+	"hz.tools/sdr/pluto/iio"
 )
 
 func init() {
@@ -35,17 +40,37 @@ func init() {
 		"pluto",
 		func(flags *pflag.FlagSet, prefix string) {
 			flags.String(prefix+"pluto-uri", "ip:pluto.local", "plutosdr to connect to")
+			flags.String(prefix+"pluto-serial", "", "serial of the plutosdr to connect to, over USB or the network, instead of --pluto-uri")
 			flags.Bool(prefix+"pluto-loopback", false, "Set the PlutoSDR BIST Loopback (be sure gain is set low)")
 
 			flags.Uint(prefix+"pluto-kbuf-rx", 0, "Set the number of kernel buffers for the RX channel")
 			flags.Uint(prefix+"pluto-kbuf-tx", 0, "Set the number of kernel buffers for the TX channel")
+
+			flags.Uint(prefix+"pluto-rx-buffer-length", 1024*3, "number of samples per RX buffer (raise for high sample rates)")
+			flags.Uint(prefix+"pluto-tx-buffer-length", 1024*3, "number of samples per TX buffer (lower for less latency)")
+
+			flags.String(prefix+"pluto-rx-port", "", fmt.Sprintf("[%s] RX RF port, left as-is if unset", strings.Join(plutoRxPorts, "|")))
+			flags.String(prefix+"pluto-tx-port", "", fmt.Sprintf("[%s] TX RF port, left as-is if unset", strings.Join(plutoTxPorts, "|")))
+			flags.Float64(prefix+"pluto-tx-attenuation", 0, "TX attenuation in dB (0 to 89.75, in 0.25dB steps), left as-is if unset")
 		},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
 			flags := c.Flags()
 			uri, err := flags.GetString(prefix + "pluto-uri")
 			if err != nil {
 				return nil, err
 			}
+			serial, err := flags.GetString(prefix + "pluto-serial")
+			if err != nil {
+				return nil, err
+			}
+			if serial != "" {
+				if flags.Changed(prefix + "pluto-uri") {
+					return nil, newSDRError(ErrInvalidFlag, "pluto", fmt.Errorf("can't set both uri and serial"))
+				}
+				if uri, err = findPlutoBySerial(serial); err != nil {
+					return nil, err
+				}
+			}
 			loopback, err := flags.GetBool(prefix + "pluto-loopback")
 			if err != nil {
 				return nil, err
@@ -58,23 +83,212 @@ func init() {
 			if err != nil {
 				return nil, err
 			}
+			rxBufLen, err := flags.GetUint(prefix + "pluto-rx-buffer-length")
+			if err != nil {
+				return nil, err
+			}
+			txBufLen, err := flags.GetUint(prefix + "pluto-tx-buffer-length")
+			if err != nil {
+				return nil, err
+			}
+			if rxBufLen == 0 || txBufLen == 0 {
+				return nil, newSDRError(ErrInvalidFlag, "pluto", fmt.Errorf("buffer lengths must be greater than 0"))
+			}
+			rfOpts, err := parsePlutoRFOptions(flags, prefix)
+			if err != nil {
+				return nil, err
+			}
+
 			p, err := pluto.OpenWithOptions(uri, pluto.Options{
-				RxBufferLength:       1024 * 3,
-				TxBufferLength:       1024 * 3,
+				RxBufferLength:       int(rxBufLen),
+				TxBufferLength:       int(txBufLen),
 				RxKernelBuffersCount: kbufRx,
 				TxKernelBuffersCount: kbufTx,
 			})
 			if err != nil {
-				return nil, err
+				return nil, newSDRError(ErrDriver, "pluto", err)
 			}
+			cleanup.Push(p.Close)
 			if loopback {
 				if err := p.SetLoopback(true); err != nil {
-					return nil, err
+					return nil, driverError("pluto", err)
 				}
 			}
+			if err := rfOpts.Apply(uri, p, cleanup); err != nil {
+				return nil, err
+			}
 			return p, nil
 		},
 	)
+
+	addSdrCompletion("pluto-serial", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		devices, err := discoverPlutos()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ret := []string{}
+		for _, dev := range devices {
+			ret = append(ret, fmt.Sprintf("%s\t%s", dev.Info.Serial, dev.Flags["pluto-uri"]))
+		}
+		return ret, cobra.ShellCompDirectiveNoFileComp
+	})
+	addSdrCompletion("pluto-uri", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		devices, err := discoverPlutos()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ret := []string{}
+		for _, dev := range devices {
+			ret = append(ret, fmt.Sprintf("%s\t%s", dev.Flags["pluto-uri"], dev.Info.Serial))
+		}
+		return ret, cobra.ShellCompDirectiveNoFileComp
+	})
+	addSdrCompletion("pluto-rx-port", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return plutoRxPorts, cobra.ShellCompDirectiveNoFileComp
+	})
+	addSdrCompletion("pluto-tx-port", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return plutoTxPorts, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	addSdrGainStages(
+		"pluto",
+		[2]string{"RX", "Rx gain, -1 to 73 dB"},
+		[2]string{"TX", "Tx gain, -89.75 to 0 dB"},
+	)
+}
+
+const (
+	// plutoPhyName is the iio device that controls the AD936x.
+	plutoPhyName = "ad9361-phy"
+
+	// plutoMaxTxAttenuation is the most TX attenuation the AD936x can do,
+	// in dB.
+	plutoMaxTxAttenuation = 89.75
+
+	// plutoTxAttenuationStep is the resolution of the AD936x TX
+	// attenuation, in dB.
+	plutoTxAttenuationStep = 0.25
+)
+
+var (
+	// plutoRxPorts are the values the AD936x takes for the RX rf_port_select.
+	plutoRxPorts = []string{
+		"A_BALANCED", "B_BALANCED", "C_BALANCED",
+		"A_N", "A_P", "B_N", "B_P", "C_N", "C_P",
+		"TX_MONITOR1", "TX_MONITOR2", "TX_MONITOR1_2",
+	}
+
+	// plutoTxPorts are the values the AD936x takes for the TX rf_port_select.
+	plutoTxPorts = []string{"A", "B"}
+)
+
+// plutoValidPort will check that port is one of ports.
+func plutoValidPort(port string, ports []string) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// plutoRFOptions are the AD936x settings that hz.tools/sdr/pluto doesn't
+// expose. Zero values leave the device setting unchanged.
+type plutoRFOptions struct {
+	RxPort        string
+	TxPort        string
+	TxAttenuation *float64
+}
+
+// parsePlutoRFOptions will parse and check the --pluto-* RF flags.
+func parsePlutoRFOptions(flags *pflag.FlagSet, prefix string) (plutoRFOptions, error) {
+	var (
+		opts plutoRFOptions
+		err  error
+	)
+
+	opts.RxPort, err = flags.GetString(prefix + "pluto-rx-port")
+	if err != nil {
+		return opts, err
+	}
+	opts.RxPort = strings.ToUpper(opts.RxPort)
+	if opts.RxPort != "" && !plutoValidPort(opts.RxPort, plutoRxPorts) {
+		return opts, newSDRError(ErrInvalidFlag, "pluto", fmt.Errorf("unknown RX port: %s", opts.RxPort))
+	}
+
+	opts.TxPort, err = flags.GetString(prefix + "pluto-tx-port")
+	if err != nil {
+		return opts, err
+	}
+	opts.TxPort = strings.ToUpper(opts.TxPort)
+	if opts.TxPort != "" && !plutoValidPort(opts.TxPort, plutoTxPorts) {
+		return opts, newSDRError(ErrInvalidFlag, "pluto", fmt.Errorf("unknown TX port: %s", opts.TxPort))
+	}
+
+	if flags.Changed(prefix + "pluto-tx-attenuation") {
+		att, err := flags.GetFloat64(prefix + "pluto-tx-attenuation")
+		if err != nil {
+			return opts, err
+		}
+		if att < 0 || att > plutoMaxTxAttenuation {
+			return opts, newSDRError(ErrInvalidGain, "pluto", fmt.Errorf("TX attenuation %.2f isn't between 0 and %.2f", att, plutoMaxTxAttenuation))
+		}
+		if steps := att / plutoTxAttenuationStep; steps != math.Trunc(steps) {
+			return opts, newSDRError(ErrInvalidGain, "pluto", fmt.Errorf("TX attenuation %g isn't a multiple of %.2f dB", att, plutoTxAttenuationStep))
+		}
+		opts.TxAttenuation = &att
+	}
+
+	return opts, nil
+}
+
+// Apply will set the options, by way of a second iio context to the same
+// Pluto, since hz.tools/sdr/pluto keeps its channels to itself.
+func (opts plutoRFOptions) Apply(uri string, p *pluto.Sdr, cleanup *closers) error {
+	if opts.RxPort == "" && opts.TxPort == "" && opts.TxAttenuation == nil {
+		return nil
+	}
+
+	ictx, err := iio.Open(uri)
+	if err != nil {
+		return newSDRError(ErrDriver, "pluto", err)
+	}
+	cleanup.Push(ictx.Close)
+
+	phy, err := ictx.FindDevice(plutoPhyName)
+	if err != nil {
+		return newSDRError(ErrDriver, "pluto", err)
+	}
+
+	if opts.RxPort != "" {
+		rx, err := phy.FindChannel("voltage0", iio.ChannelDirectionRead)
+		if err != nil {
+			return newSDRError(ErrDriver, "pluto", err)
+		}
+		if err := rx.WriteString("rf_port_select", opts.RxPort); err != nil {
+			return newSDRError(ErrDriver, "pluto", fmt.Errorf("RX port %s: %w", opts.RxPort, err))
+		}
+	}
+
+	if opts.TxPort == "" && opts.TxAttenuation == nil {
+		return nil
+	}
+	tx, err := phy.FindChannel("voltage0", iio.ChannelDirectionWrite)
+	if err != nil {
+		return newSDRError(ErrDriver, "pluto", err)
+	}
+	if opts.TxPort != "" {
+		if err := tx.WriteString("rf_port_select", opts.TxPort); err != nil {
+			return newSDRError(ErrDriver, "pluto", fmt.Errorf("TX port %s: %w", opts.TxPort, err))
+		}
+	}
+	if opts.TxAttenuation != nil {
+		// The AD936x takes TX attenuation as a negative hardware gain.
+		if err := tx.WriteFloat64("hardwaregain", -*opts.TxAttenuation); err != nil {
+			return newSDRError(ErrDriver, "pluto", fmt.Errorf("TX attenuation: %w", err))
+		}
+	}
+	return nil
 }
 
 // vim: foldmethod=marker
@@ -0,0 +1,224 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+//go:build !sdr.nopluto
+
+package cli
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"hz.tools/sdr"
+	"hz.tools/sdr/pluto/iio"
+)
+
+func init() {
+	addSdrDiscovery("pluto", discoverPlutos)
+	plutoInfoByURI = readPlutoInfo
+	plutoURIBySerial = findPlutoBySerial
+}
+
+const (
+	// plutoUSBVendor and plutoUSBProduct are the USB IDs of the ADALM-PLUTO.
+	plutoUSBVendor  = "0456"
+	plutoUSBProduct = "b673"
+
+	// plutoUSBInterface is the USB interface libiio talks to on the Pluto.
+	plutoUSBInterface = 5
+
+	// plutoIIODPort is the port iiod listens on for ip: URIs.
+	plutoIIODPort = "30431"
+
+	// plutoProbeTimeout is how long to wait for iiod on each well known
+	// address when looking for Plutos on the network.
+	plutoProbeTimeout = 500 * time.Millisecond
+)
+
+// plutoNetworkHosts are the addresses a Pluto answers on out of the box,
+// over mDNS or the USB ethernet gadget.
+var plutoNetworkHosts = []string{"pluto.local", "192.168.2.1"}
+
+// discoverPlutos will find Plutos plugged in over USB, and those answering
+// on the usual network addresses.
+func discoverPlutos() ([]SDRDevice, error) {
+	ret, err := discoverUSBPlutos()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, dev := range ret {
+		seen[dev.Info.Serial] = true
+	}
+
+	for _, host := range plutoNetworkHosts {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, plutoIIODPort), plutoProbeTimeout)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		uri := "ip:" + host
+		info, err := readPlutoInfo(uri)
+		if err != nil {
+			continue
+		}
+		// A Pluto on USB is also on the network by way of the ethernet
+		// gadget, so only list it once.
+		if info.Serial != "" && seen[info.Serial] {
+			continue
+		}
+		seen[info.Serial] = true
+		ret = append(ret, SDRDevice{
+			Backend: "pluto",
+			Flags:   map[string]string{"pluto-uri": uri},
+			Info: sdr.HardwareInfo{
+				Manufacturer: "Analog Devices",
+				Product:      info.Model,
+				Serial:       info.Serial,
+			},
+		})
+	}
+	return ret, nil
+}
+
+// discoverUSBPlutos will find Plutos on the USB bus by way of sysfs, without
+// opening them, so it works even when they're in use. There's no sysfs
+// outside of Linux, so nothing will be found there.
+func discoverUSBPlutos() ([]SDRDevice, error) {
+	ret := []SDRDevice{}
+
+	paths, err := filepath.Glob("/sys/bus/usb/devices/*/idVendor")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if readSysfs(dir, "idVendor") != plutoUSBVendor || readSysfs(dir, "idProduct") != plutoUSBProduct {
+			continue
+		}
+		bus, err := strconv.Atoi(readSysfs(dir, "busnum"))
+		if err != nil {
+			continue
+		}
+		addr, err := strconv.Atoi(readSysfs(dir, "devnum"))
+		if err != nil {
+			continue
+		}
+		ret = append(ret, SDRDevice{
+			Backend: "pluto",
+			Flags: map[string]string{
+				"pluto-uri": fmt.Sprintf("usb:%d.%d.%d", bus, addr, plutoUSBInterface),
+			},
+			Info: sdr.HardwareInfo{
+				Manufacturer: readSysfs(dir, "manufacturer"),
+				Product:      readSysfs(dir, "product"),
+				Serial:       readSysfs(dir, "serial"),
+			},
+		})
+	}
+	return ret, nil
+}
+
+// readSysfs will read a sysfs attribute, or return an empty string.
+func readSysfs(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// findPlutoBySerial will return the URI of the Pluto with the serial.
+func findPlutoBySerial(serial string) (string, error) {
+	devices, err := discoverPlutos()
+	if err != nil {
+		return "", err
+	}
+	for _, dev := range devices {
+		if dev.Info.Serial == serial {
+			return dev.Flags["pluto-uri"], nil
+		}
+	}
+	return "", newSDRError(ErrDeviceNotFound, "pluto", fmt.Errorf("no pluto with serial %s found", serial))
+}
+
+// readPlutoInfo will connect to the Pluto at uri, and read what it says
+// about itself.
+func readPlutoInfo(uri string) (*plutoInfo, error) {
+	ictx, err := iio.Open(uri)
+	if err != nil {
+		return nil, newSDRError(ErrDeviceNotFound, "pluto", fmt.Errorf("%s: %w", uri, err))
+	}
+	defer ictx.Close()
+
+	attr := func(name string) string {
+		if value := ictx.Attr(name); value != nil {
+			return *value
+		}
+		return ""
+	}
+
+	info := &plutoInfo{
+		URI:      uri,
+		Model:    attr("hw_model"),
+		Serial:   attr("hw_serial"),
+		Firmware: attr("fw_version"),
+	}
+
+	phy, err := ictx.FindDevice(plutoPhyName)
+	if err != nil {
+		return nil, newSDRError(ErrDriver, "pluto", err)
+	}
+	if temp, err := phy.FindChannel("temp0", iio.ChannelDirectionRead); err == nil {
+		if milliC, err := temp.ReadInt64("input"); err == nil {
+			info.Temperature = float64(milliC) / 1000
+		}
+	}
+
+	// The streaming devices have an I and a Q channel for each RF channel,
+	// so a 2R2T Pluto has four of each.
+	info.RxChannels = countIIOChannels(ictx, "cf-ad9361-lpc", iio.ChannelDirectionRead) / 2
+	info.TxChannels = countIIOChannels(ictx, "cf-ad9361-dds-core-lpc", iio.ChannelDirectionWrite) / 2
+
+	return info, nil
+}
+
+// countIIOChannels will count the voltageN channels of the device.
+func countIIOChannels(ictx *iio.Context, device string, direction iio.ChannelDirection) int {
+	dev, err := ictx.FindDevice(device)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for ; ; n++ {
+		if _, err := dev.FindChannel(fmt.Sprintf("voltage%d", n), direction); err != nil {
+			return n
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -24,15 +24,13 @@ package cli
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
-	"hz.tools/fftw"
 	"hz.tools/sdr"
 	"hz.tools/sdr/rtl"
-	"hz.tools/sdr/rtl/kerberos"
-	"hz.tools/sdr/rtltcp"
 )
 
 func init() {
@@ -43,8 +41,9 @@ func init() {
 			flags.String(prefix+"rtl-serial", "", "serial number to use")
 			flags.Uint(prefix+"rtl-device-index", 0, "device index to use")
 			flags.Bool(prefix+"rtl-bias-t", false, "Set bias-T state")
+			flags.Float32(prefix+"rtl-if-gain", 0, "IF gain in dB (E4000 tuners only)")
 		},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
 			flags := c.Flags()
 			serial, err := flags.GetString(prefix + "rtl-serial")
 			if err != nil {
@@ -56,25 +55,26 @@ func init() {
 			}
 			if serial != "" {
 				if deviceIndex != 0 {
-					return nil, fmt.Errorf("rfutil: can't set both serial and index")
+					return nil, newSDRError(ErrInvalidFlag, "rtl", fmt.Errorf("can't set both serial and index"))
 				}
 				deviceIndex, err = rtl.DeviceIndexBySerial(serial)
 				if err != nil {
-					return nil, err
+					return nil, newSDRError(ErrDeviceNotFound, "rtl", err)
 				}
 			}
 			rtlCount := rtl.DeviceCount()
 			if rtlCount == 0 {
-				return nil, fmt.Errorf("rfutil: no rtl devices found")
+				return nil, newSDRError(ErrDeviceNotFound, "rtl", fmt.Errorf("no rtl devices found"))
 			}
 
-			if rtlCount < deviceIndex {
-				return nil, fmt.Errorf("rfutil: index isn't valid")
+			if rtlCount <= deviceIndex {
+				return nil, newSDRError(ErrDeviceNotFound, "rtl", fmt.Errorf("index %d isn't valid", deviceIndex))
 			}
 			dev, err := rtl.New(deviceIndex, 0)
 			if err != nil {
-				return nil, err
+				return nil, rtlOpenError("rtl", err)
 			}
+			cleanup.Push(dev.Close)
 
 			biasT, err := flags.GetBool(prefix + "rtl-bias-t")
 			if err != nil {
@@ -83,46 +83,86 @@ func init() {
 			if err := dev.SetBiasT(biasT); err != nil {
 				return nil, err
 			}
+
+			if flags.Changed(prefix + "rtl-if-gain") {
+				ifGain, err := flags.GetFloat32(prefix + "rtl-if-gain")
+				if err != nil {
+					return nil, err
+				}
+				if err := checkRtlIFGain("rtl", dev.Tuner(), ifGain); err != nil {
+					return nil, err
+				}
+				if err := setRtlIFGain(dev, ifGain); err != nil {
+					return nil, driverError("rtl", fmt.Errorf("IF gain: %w", err))
+				}
+			}
 			return dev, nil
 		},
 	)
 
-	addSdr(
-		"rtltcp",
-		func(flags *pflag.FlagSet, prefix string) {
-			flags.String(prefix+"rtltcp-host", "localhost", "fqdn to connect to")
-			flags.Uint(prefix+"rtltcp-port", 1234, "remote port to use")
-		},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
-			flags := c.Flags()
-			fqdn, err := flags.GetString(prefix + "rtltcp-host")
+	addSdrCompletion("rtl-serial", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		ret := []string{}
+		for i := uint(0); i < rtl.DeviceCount(); i++ {
+			info, err := rtl.InfoByDeviceIndex(i)
 			if err != nil {
-				return nil, err
+				continue
 			}
-			port, err := flags.GetUint(prefix + "rtltcp-port")
-			if err != nil {
-				return nil, err
-			}
-			addr := fmt.Sprintf("%s:%d", fqdn, port)
-			return rtltcp.Dial("tcp", addr)
-		},
-	)
+			ret = append(ret, fmt.Sprintf("%s\t%s %s", info.Serial, info.Manufacturer, info.Product))
+		}
+		return ret, cobra.ShellCompDirectiveNoFileComp
+	})
 
-	addSdr(
-		"kerberos-coherent",
-		func(flags *pflag.FlagSet, prefix string) {},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
-			return kerberos.NewCoherent(fftw.Plan, 0, 1, 2, 3, 0)
-		},
+	addSdrGainStages(
+		"rtl",
+		[2]string{"Tuner", "tuner gain"},
+		[2]string{"IF", "IF gain, E4000 tuners only"},
 	)
+}
 
-	addSdr(
-		"kerberos-offset",
-		func(flags *pflag.FlagSet, prefix string) {},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
-			return kerberos.NewOffset(fftw.Plan, 0, 1, 2, 3, 0)
-		},
-	)
+// setRtlIFGain will set the IF gain stage, which only E4000 tuners have.
+func setRtlIFGain(dev sdr.Sdr, gain float32) error {
+	stages, err := dev.GetGainStages()
+	if err != nil {
+		return err
+	}
+	ifStage := stages.First(sdr.GainStageTypeIF)
+	if ifStage == nil {
+		return sdr.ErrNotSupported
+	}
+	return dev.SetGain(ifStage, gain)
+}
+
+// checkRtlIFGain will check that the tuner has an IF gain stage (which only
+// E4000 tuners do), and that the gain is within its range.
+func checkRtlIFGain(backend string, tuner rtl.Tuner, gain float32) error {
+	if tuner != rtl.TunerE4000 {
+		return newSDRError(ErrUnsupportedSetting, backend, fmt.Errorf("IF gain isn't supported by the %s tuner", tuner))
+	}
+	stages, err := tuner.GetGainStages()
+	if err != nil {
+		return driverError(backend, err)
+	}
+	ifStage := stages.First(sdr.GainStageTypeIF)
+	if ifStage == nil {
+		return newSDRError(ErrUnsupportedSetting, backend, fmt.Errorf("IF gain isn't supported by the %s tuner", tuner))
+	}
+	gainRange := ifStage.Range()
+	if gain < gainRange[0] || gain > gainRange[1] {
+		return newSDRError(ErrInvalidGain, backend, fmt.Errorf(
+			"IF gain %.1f is outside of %.1f to %.1f", gain, gainRange[0], gainRange[1],
+		))
+	}
+	return nil
+}
+
+// rtlOpenError will classify an error returned when opening an rtl device.
+// librtlsdr hands back the raw libusb error code when it can't claim the
+// interface, which is LIBUSB_ERROR_BUSY (-6) when someone else has it open.
+func rtlOpenError(backend string, err error) error {
+	if strings.HasSuffix(err.Error(), ": -6") {
+		return newSDRError(ErrDeviceBusy, backend, err)
+	}
+	return newSDRError(ErrDriver, backend, err)
 }
 
 // vim: foldmethod=marker
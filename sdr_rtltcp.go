@@ -0,0 +1,393 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+//go:build !sdr.nortl
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"hz.tools/rf"
+	"hz.tools/sdr"
+	"hz.tools/sdr/rtl"
+	"hz.tools/sdr/rtl/e4k"
+	"hz.tools/sdr/rtltcp"
+)
+
+func init() {
+	addSdr(
+		"rtltcp",
+		func(flags *pflag.FlagSet, prefix string) {
+			flags.String(prefix+"rtltcp-host", "localhost", "fqdn or IP (v4 or v6) to connect to")
+			flags.Uint(prefix+"rtltcp-port", 1234, "remote port to use")
+			flags.String(prefix+"rtltcp-unix", "", "unix socket to connect to, instead of host and port")
+			flags.Duration(prefix+"rtltcp-connect-timeout", time.Duration(0), "time to wait for the server (0 waits until the context is done)")
+			flags.String(prefix+"rtltcp-gain-mode", "", "tuner gain mode [auto|manual]")
+			flags.Int(prefix+"rtltcp-gain-index", -1, "tuner gain, as an index into the server's tuner gain table (not range checked)")
+			flags.Bool(prefix+"rtltcp-rtl-agc", false, "enable the RTL2832U digital AGC")
+			flags.Int(prefix+"rtltcp-ppm", 0, "frequency correction, in ppm")
+			flags.Bool(prefix+"rtltcp-bias-t", false, "enable the bias-T")
+			addRtlTcpTunerFlags(flags, prefix)
+		},
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
+			flags := c.Flags()
+			network, addr, err := rtltcpAddress(flags, prefix)
+			if err != nil {
+				return nil, err
+			}
+			timeout, err := flags.GetDuration(prefix + "rtltcp-connect-timeout")
+			if err != nil {
+				return nil, err
+			}
+			gainMode, err := flags.GetString(prefix + "rtltcp-gain-mode")
+			if err != nil {
+				return nil, err
+			}
+			gainIndex, err := flags.GetInt(prefix + "rtltcp-gain-index")
+			if err != nil {
+				return nil, err
+			}
+			rtlAgc, err := flags.GetBool(prefix + "rtltcp-rtl-agc")
+			if err != nil {
+				return nil, err
+			}
+			ppm, err := flags.GetInt(prefix + "rtltcp-ppm")
+			if err != nil {
+				return nil, err
+			}
+			biasT, err := flags.GetBool(prefix + "rtltcp-bias-t")
+			if err != nil {
+				return nil, err
+			}
+			tunerOpts, err := parseRtlTcpTunerOptions(flags, prefix)
+			if err != nil {
+				return nil, err
+			}
+
+			ctx := commandContext(c)
+			if timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			dev, err := dialRtlTcp(ctx, network, addr)
+			if err != nil {
+				return nil, newSDRError(ErrDeviceNotFound, "rtltcp", err)
+			}
+			cleanup.Push(dev.Close)
+
+			tuner := dev.Tuner()
+			log.WithFields(log.Fields{
+				"rtltcp.address": addr,
+				"rtltcp.tuner":   tuner,
+			}).Info("Connected to rtl_tcp")
+
+			if err := tunerOpts.Validate(tuner); err != nil {
+				return nil, err
+			}
+
+			var requests []rtltcp.Request
+
+			switch gainMode {
+			case "":
+				if gainIndex >= 0 {
+					// Setting the tuner gain is ignored unless the tuner
+					// is in manual gain mode.
+					requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetGainMode, Argument: 1})
+				}
+			case "auto":
+				requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetGainMode, Argument: 0})
+			case "manual":
+				requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetGainMode, Argument: 1})
+			default:
+				return nil, newSDRError(ErrInvalidGain, "rtltcp", fmt.Errorf("unknown gain mode: %s", gainMode))
+			}
+
+			if gainIndex >= 0 {
+				// rtltcp.Dial reads the dongle info header itself, and the
+				// Client only hands back the tuner type, not the gain
+				// count. The header can't be read a second time, so the
+				// index isn't checked here; rtl_tcp ignores out of range
+				// indexes.
+				requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetTunerGainByIndex, Argument: uint32(gainIndex)})
+			}
+			if rtlAgc {
+				requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetAGCMode, Argument: 1})
+			}
+			if ppm != 0 {
+				requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetFreqCorrection, Argument: uint32(int32(ppm))})
+			}
+			if biasT {
+				requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetBiasTee, Argument: 1})
+			}
+
+			for _, req := range requests {
+				if err := dev.SendCommand(req); err != nil {
+					return nil, driverError("rtltcp", fmt.Errorf("%s: %w", req.Command, err))
+				}
+			}
+
+			if err := tunerOpts.Apply(dev); err != nil {
+				return nil, err
+			}
+			return dev, nil
+		},
+	)
+
+	addSdrCompletion("rtltcp-direct-sampling", completeRtlTcpDirectSampling)
+	addSdrCompletion("rtltcp-gain-mode", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"auto", "manual"}, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	addSdrGainStages(
+		"rtltcp",
+		[2]string{"Tuner", "tuner gain"},
+		[2]string{"IF", "IF gain, E4000 tuners only"},
+	)
+}
+
+// rtltcpAddress will return the network and address to dial, from the
+// --rtltcp-unix, --rtltcp-host and --rtltcp-port flags.
+func rtltcpAddress(flags *pflag.FlagSet, prefix string) (string, string, error) {
+	socket, err := flags.GetString(prefix + "rtltcp-unix")
+	if err != nil {
+		return "", "", err
+	}
+	if socket != "" {
+		return "unix", socket, nil
+	}
+
+	host, err := flags.GetString(prefix + "rtltcp-host")
+	if err != nil {
+		return "", "", err
+	}
+	port, err := flags.GetUint(prefix + "rtltcp-port")
+	if err != nil {
+		return "", "", err
+	}
+	// Allow IPv6 literals to be passed with or without brackets.
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return "tcp", net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)), nil
+}
+
+// dialRtlTcp will connect to an rtl_tcp server, giving up once the context is
+// done. rtltcp.Dial can't be interrupted, so if it finishes after we've given
+// up, the connection is closed.
+//
+// The dongle info header is read (and checked) by rtltcp.Dial, which only
+// keeps the tuner type where we can get at it; the tuner gain count isn't
+// available.
+func dialRtlTcp(ctx context.Context, network, address string) (*rtltcp.Client, error) {
+	type dialResult struct {
+		client *rtltcp.Client
+		err    error
+	}
+
+	results := make(chan dialResult, 1)
+	go func() {
+		client, err := rtltcp.Dial(network, address)
+		results <- dialResult{client: client, err: err}
+	}()
+
+	select {
+	case result := <-results:
+		return result.client, result.err
+	case <-ctx.Done():
+		go func() {
+			if result := <-results; result.client != nil {
+				result.client.Close()
+			}
+		}()
+		return nil, fmt.Errorf("connecting to %s: %w", address, ctx.Err())
+	}
+}
+
+// rtlTcpDirectSamplingModes maps the values accepted by
+// --rtltcp-direct-sampling to the mode numbers used by the rtl_tcp protocol.
+var rtlTcpDirectSamplingModes = map[string]uint32{
+	"off": 0,
+	"i":   1,
+	"q":   2,
+}
+
+// rtlXtalTolerance is how far from the nominal 28.8 MHz the RTL2832U crystal
+// frequency may be set, matching the limits enforced by librtlsdr.
+const rtlXtalTolerance = rf.Hz(1000)
+
+// rtlNominalXtal is the nominal RTL2832U crystal frequency.
+const rtlNominalXtal = rf.Hz(28.8e6)
+
+// rtlTcpTunerOptions are the tuner and demodulator options of the rtltcp
+// backend. Zero values leave the device setting unchanged.
+type rtlTcpTunerOptions struct {
+	// DirectSampling is the direct sampling mode (see
+	// rtlTcpDirectSamplingModes).
+	DirectSampling uint32
+
+	// OffsetTuning will enable offset tuning, to avoid the DC spike.
+	OffsetTuning bool
+
+	// RtlXtal is the RTL2832U crystal frequency.
+	RtlXtal rf.Hz
+
+	// TunerXtal is the tuner crystal frequency.
+	TunerXtal rf.Hz
+
+	// IFGain is the E4000 IF gain, in dB, or nil to leave it alone.
+	IFGain *float32
+}
+
+// addRtlTcpTunerFlags will register the flags parsed by
+// parseRtlTcpTunerOptions.
+func addRtlTcpTunerFlags(flags *pflag.FlagSet, prefix string) {
+	flags.String(prefix+"rtltcp-direct-sampling", "off", "direct sampling mode, for HF reception [off|i|q]")
+	flags.Bool(prefix+"rtltcp-offset-tuning", false, "enable offset tuning (not supported on R820T/R828D tuners)")
+	flags.String(prefix+"rtltcp-xtal-freq", "", "RTL2832U crystal frequency, within 1kHz of 28.8MHz")
+	flags.String(prefix+"rtltcp-tuner-xtal", "", "tuner crystal frequency")
+	flags.Float32(prefix+"rtltcp-if-gain", 0, "IF gain in dB (E4000 tuners only)")
+}
+
+// parseRtlTcpTunerOptions will parse the flags registered by
+// addRtlTcpTunerFlags.
+func parseRtlTcpTunerOptions(flags *pflag.FlagSet, prefix string) (rtlTcpTunerOptions, error) {
+	var opts rtlTcpTunerOptions
+
+	directSampling, err := flags.GetString(prefix + "rtltcp-direct-sampling")
+	if err != nil {
+		return opts, err
+	}
+	mode, ok := rtlTcpDirectSamplingModes[directSampling]
+	if !ok {
+		return opts, newSDRError(ErrInvalidFlag, "rtltcp", fmt.Errorf("unknown direct sampling mode: %s", directSampling))
+	}
+	opts.DirectSampling = mode
+
+	if opts.OffsetTuning, err = flags.GetBool(prefix + "rtltcp-offset-tuning"); err != nil {
+		return opts, err
+	}
+
+	for flagName, target := range map[string]*rf.Hz{
+		prefix + "rtltcp-xtal-freq":  &opts.RtlXtal,
+		prefix + "rtltcp-tuner-xtal": &opts.TunerXtal,
+	} {
+		value, err := flags.GetString(flagName)
+		if err != nil {
+			return opts, err
+		}
+		if value == "" {
+			continue
+		}
+		if *target, err = rf.ParseHz(value); err != nil {
+			return opts, newSDRError(ErrInvalidFlag, "rtltcp", fmt.Errorf("--%s: %w", flagName, err))
+		}
+	}
+
+	if flags.Changed(prefix + "rtltcp-if-gain") {
+		ifGain, err := flags.GetFloat32(prefix + "rtltcp-if-gain")
+		if err != nil {
+			return opts, err
+		}
+		opts.IFGain = &ifGain
+	}
+	return opts, nil
+}
+
+// Validate will check the options against the tuner reported by the server,
+// and return an ErrUnsupportedSetting if the tuner can't do what was asked.
+func (opts rtlTcpTunerOptions) Validate(tuner rtl.Tuner) error {
+	if opts.OffsetTuning && (tuner == rtl.TunerR820T || tuner == rtl.TunerR828D) {
+		return newSDRError(ErrUnsupportedSetting, "rtltcp", fmt.Errorf("offset tuning isn't supported by the %s tuner", tuner))
+	}
+
+	if opts.RtlXtal != 0 {
+		if opts.RtlXtal < rtlNominalXtal-rtlXtalTolerance || opts.RtlXtal > rtlNominalXtal+rtlXtalTolerance {
+			return newSDRError(ErrInvalidFlag, "rtltcp", fmt.Errorf("rtl crystal frequency %s is too far from %s", opts.RtlXtal, rtlNominalXtal))
+		}
+	}
+
+	if opts.IFGain != nil {
+		return checkRtlIFGain("rtltcp", tuner, *opts.IFGain)
+	}
+	return nil
+}
+
+// Apply will send the options to the rtl_tcp server. Options left at their
+// zero value are not sent.
+func (opts rtlTcpTunerOptions) Apply(dev *rtltcp.Client) error {
+	var requests []rtltcp.Request
+	if opts.DirectSampling != 0 {
+		requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetDirectSampling, Argument: opts.DirectSampling})
+	}
+	if opts.OffsetTuning {
+		requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetOffsetTuning, Argument: 1})
+	}
+	if opts.RtlXtal != 0 {
+		requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetRtlXtalFreq, Argument: uint32(opts.RtlXtal)})
+	}
+	if opts.TunerXtal != 0 {
+		requests = append(requests, rtltcp.Request{Command: rtltcp.CommandSetTunerXtalFreq, Argument: uint32(opts.TunerXtal)})
+	}
+	if opts.IFGain != nil {
+		// rtl_tcp sets the IF gain one E4000 stage at a time, with the
+		// stage number in the top 16 bits and the gain (in tenths of a
+		// dB) in the bottom 16 bits.
+		stages, err := e4k.IFGainStages(uint(*opts.IFGain))
+		if err != nil {
+			return newSDRError(ErrInvalidGain, "rtltcp", err)
+		}
+		for i, stageGain := range stages {
+			requests = append(requests, rtltcp.Request{
+				Command:  rtltcp.CommandSetIFGain,
+				Argument: uint32(i+1)<<16 | uint32(uint16(int16(stageGain))),
+			})
+		}
+	}
+
+	for _, req := range requests {
+		if err := dev.SendCommand(req); err != nil {
+			return driverError("rtltcp", fmt.Errorf("%s: %w", req.Command, err))
+		}
+	}
+	return nil
+}
+
+// completeRtlTcpDirectSampling will complete the --rtltcp-direct-sampling
+// flag.
+func completeRtlTcpDirectSampling(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{
+		"off\tuse the tuner",
+		"i\tsample the I branch directly",
+		"q\tsample the Q branch directly",
+	}, cobra.ShellCompDirectiveNoFileComp
+}
+
+// vim: foldmethod=marker
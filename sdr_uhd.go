@@ -23,11 +23,19 @@
 package cli
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
+	"hz.tools/rf"
 	"hz.tools/sdr"
 	"hz.tools/sdr/uhd"
 )
@@ -41,10 +49,14 @@ func init() {
 			flags.Int(prefix+"uhd-tx-channel", 0, "tx channel to use")
 			flags.String(prefix+"uhd-sample-format", "i16", "[i8|i16|c64]")
 			flags.String(prefix+"uhd-time-source", "", "clock source to use, check UHD docs for help")
+			flags.String(prefix+"uhd-clock-source", "", fmt.Sprintf("[%s] 10MHz reference to use", strings.Join(uhdClockSources, "|")))
 			flags.Int(prefix+"uhd-buffer-length", 10, "Set the underlying buffer queue length")
+			flags.String(prefix+"uhd-master-clock-rate", "", "master clock rate (such as 30.72MHz), for devices that support changing it")
+			flags.Bool(prefix+"uhd-sync-pps", false, "set the device time from the system clock on the next PPS edge")
+			flags.String(prefix+"uhd-start-at", "", "start streaming at a set time, either a delay after the device is opened or --start-at, whichever is later (such as 2s), or at a time (RFC3339, needs --uhd-sync-pps)")
 			flags.String(prefix+"uhd-args", "", "underlying uhd arguments to pass to libuhd")
 		},
-		func(c *cobra.Command, prefix string) (sdr.Sdr, error) {
+		func(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, error) {
 			flags := c.Flags()
 			rxChannels, err := flags.GetIntSlice(prefix + "uhd-rx-channels")
 			if err != nil {
@@ -71,10 +83,22 @@ func init() {
 				return nil, err
 			}
 
+			if bufLength < 0 {
+				return nil, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("buffer length can't be negative"))
+			}
+
 			uhdArgs, err := flags.GetString(prefix + "uhd-args")
 			if err != nil {
 				return nil, err
 			}
+			opts, err := parseUhdOptions(flags, prefix)
+			if err != nil {
+				return nil, err
+			}
+			uhdArgs, err = opts.Args(uhdArgs)
+			if err != nil {
+				return nil, err
+			}
 
 			var sampleFormat sdr.SampleFormat
 			switch sampleFormatStr {
@@ -85,29 +109,324 @@ func init() {
 			case "c64":
 				sampleFormat = sdr.SampleFormatC64
 			default:
-				return nil, sdr.ErrSampleFormatUnknown
+				return nil, newSDRError(ErrInvalidFlag, "uhd", sdr.ErrSampleFormatUnknown)
 			}
-			_ = bufLength
-			uhd, err := uhd.Open(uhd.Options{
+			dev, err := uhd.Open(uhd.Options{
 				Args:         uhdArgs,
 				RxChannels:   rxChannels,
 				RxChannel:    rxChannel,
 				TxChannel:    txChannel,
 				SampleFormat: sampleFormat,
+				BufferLength: bufLength,
 			})
 			if err != nil {
-				return nil, err
+				if errors.Is(err, uhd.ErrKey) {
+					// UHD raises a uhd::key_error when no device matches
+					// the provided args.
+					return nil, newSDRError(ErrDeviceNotFound, "uhd", err)
+				}
+				return nil, newSDRError(ErrDriver, "uhd", err)
 			}
+			cleanup.Push(dev.Close)
 			if timeSource != "" {
-				if err := uhd.SetTimeSource(timeSource); err != nil {
-					sources, _ := uhd.GetTimeSources()
+				if err := dev.SetTimeSource(timeSource); err != nil {
+					sources, _ := dev.GetTimeSources()
 					log.Printf("Valid clock sources: %#v", sources)
+					return nil, newSDRError(ErrUnsupportedSetting, "uhd", err)
+				}
+			}
+			// There's no wait for ref_locked, lo_locked or gps_locked
+			// here, since hz.tools/sdr/uhd doesn't expose the USRP
+			// sensors. Streaming can start before an external reference
+			// has locked.
+
+			syncPPS, err := flags.GetBool(prefix + "uhd-sync-pps")
+			if err != nil {
+				return nil, err
+			}
+			startAtString, err := flags.GetString(prefix + "uhd-start-at")
+			if err != nil {
+				return nil, err
+			}
+			if !syncPPS && startAtString == "" {
+				return dev, nil
+			}
+			delay, startAt, err := parseUhdStartAt(startAtString, syncPPS)
+			if err != nil {
+				return nil, err
+			}
+			ctx := commandContext(c)
+			if syncPPS {
+				if err := syncUhdPPS(ctx, dev); err != nil {
 					return nil, err
 				}
 			}
-			return uhd, nil
+			return newUhdTimedSdr(ctx, dev, delay, startAt, syncPPS)
 		},
 	)
+
+	addSdrCompletion("uhd-time-source", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		uhdArgs, err := c.Flags().GetString(prefix + "uhd-args")
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		dev, err := uhd.Open(uhd.Options{Args: uhdArgs})
+		if err != nil {
+			cobra.CompErrorln(err.Error())
+			return nil, cobra.ShellCompDirectiveError
+		}
+		defer dev.Close()
+		sources, err := dev.GetTimeSources()
+		if err != nil {
+			cobra.CompErrorln(err.Error())
+			return nil, cobra.ShellCompDirectiveError
+		}
+		return sources, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	addSdrCompletion("uhd-clock-source", func(c *cobra.Command, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return uhdClockSources, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+const (
+	// uhdPPSMargin is how long after a whole second to set the time for the
+	// next PPS edge, to stay clear of the edge itself.
+	uhdPPSMargin = 200 * time.Millisecond
+
+	// uhdDefaultStartDelay is how long after opening a synced device to
+	// start streaming, if --uhd-start-at isn't set. This matches what
+	// uhd.Sdr.StartCoherentRx does, without it resetting the clock.
+	uhdDefaultStartDelay = time.Second
+)
+
+// syncUhdPPS will set the device time to seconds since the Unix epoch on the
+// next PPS edge, and wait for it to take. This assumes the PPS is lined up
+// with the top of the second on the system clock, which it will be if both
+// are disciplined (such as by NTP or GPS).
+func syncUhdPPS(ctx context.Context, dev *uhd.Sdr) error {
+	// Wait until just past a PPS edge, so there's most of a second to set
+	// the time before the next one.
+	now := time.Now()
+	edge := now.Truncate(time.Second).Add(time.Second)
+	if err := sleepContext(ctx, edge.Add(uhdPPSMargin).Sub(now)); err != nil {
+		return err
+	}
+
+	next := edge.Unix() + 1
+	if err := dev.SetTimeNextPPS(time.Duration(next) * time.Second); err != nil {
+		return driverError("uhd", err)
+	}
+
+	// Wait for that edge to go by before anyone relies on the time.
+	if err := sleepContext(ctx, time.Second); err != nil {
+		return err
+	}
+
+	deviceTime, err := dev.GetTimeNow()
+	if err != nil {
+		return driverError("uhd", err)
+	}
+	log.WithFields(log.Fields{
+		"uhd.time": time.Unix(0, 0).Add(deviceTime).UTC(),
+	}).Info("UHD time set on PPS")
+	return nil
+}
+
+// parseUhdStartAt will parse --uhd-start-at, which is either a delay from
+// when the device is opened (or --start-at, if that's later), or a time that
+// needs the device clock to be on Unix time, by way of --uhd-sync-pps. Only
+// one of the delay and the device time to start at is returned.
+func parseUhdStartAt(startAt string, synced bool) (time.Duration, time.Duration, error) {
+	if startAt == "" {
+		return uhdDefaultStartDelay, 0, nil
+	}
+
+	if delay, err := time.ParseDuration(startAt); err == nil {
+		if delay < 0 {
+			return 0, 0, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("start delay can't be negative"))
+		}
+		return delay, 0, nil
+	}
+
+	when, err := time.Parse(time.RFC3339Nano, startAt)
+	if err != nil {
+		return 0, 0, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("can't parse start time %q as a duration or RFC3339 time", startAt))
+	}
+	if !synced {
+		return 0, 0, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("a start time needs --uhd-sync-pps, use a delay (such as 2s) otherwise"))
+	}
+	if time.Until(when) <= 0 {
+		return 0, 0, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("start time %s has already passed", when))
+	}
+	return 0, when.Sub(time.Unix(0, 0)), nil
+}
+
+// uhdTimedSdr wraps a uhd.Sdr so that streams start at a set device time,
+// worked out when the device was opened.
+type uhdTimedSdr struct {
+	*uhd.Sdr
+
+	// startAt is the device time to start streaming at, and wallStart is
+	// the same moment on the system clock.
+	startAt   time.Duration
+	wallStart time.Time
+
+	// firstSample is how long after the last start the first sample is
+	// expected.
+	firstSample atomic.Int64
+}
+
+// newUhdTimedSdr will work out the device time to start streaming at. A
+// fixed start time is used as-is; otherwise the delay is counted from now,
+// or from --start-at if that's later.
+func newUhdTimedSdr(ctx context.Context, dev *uhd.Sdr, delay, startAt time.Duration, synced bool) (*uhdTimedSdr, error) {
+	deviceNow, err := dev.GetTimeNow()
+	if err != nil {
+		return nil, driverError("uhd", err)
+	}
+	wallNow := time.Now()
+
+	at := startAt
+	if at == 0 {
+		base := wallNow
+		if start := StartTime(ctx); start.After(base) {
+			base = start
+		}
+		at = deviceNow + base.Sub(wallNow) + delay
+	}
+
+	wallStart := wallNow.Add(at - deviceNow)
+	if synced {
+		wallStart = time.Unix(0, 0).Add(at)
+	}
+
+	log.WithFields(log.Fields{
+		"uhd.start_at":   at,
+		"uhd.start_time": wallStart.UTC(),
+	}).Info("UHD timed start")
+	return &uhdTimedSdr{Sdr: dev, startAt: at, wallStart: wallStart.UTC()}, nil
+}
+
+// start will check that the start time is still ahead of the device clock.
+func (u *uhdTimedSdr) start() (time.Duration, error) {
+	now, err := u.Sdr.GetTimeNow()
+	if err != nil {
+		return 0, err
+	}
+	if now >= u.startAt {
+		return 0, newSDRError(ErrUnsupportedSetting, "uhd", fmt.Errorf(
+			"start time %s passed before the stream was started, use a longer --uhd-start-at",
+			u.wallStart.Format(time.RFC3339Nano),
+		))
+	}
+	u.firstSample.Store(int64(u.startAt - now))
+	return u.startAt, nil
+}
+
+// StartRx implements the sdr.Sdr interface.
+func (u *uhdTimedSdr) StartRx() (sdr.ReadCloser, error) {
+	at, err := u.start()
+	if err != nil {
+		return nil, err
+	}
+	return u.Sdr.StartRxAt(at)
+}
+
+// StartCoherentRx will start all the rx channels at the set device time.
+// Unlike uhd.Sdr.StartCoherentRx, this leaves the device clock alone.
+func (u *uhdTimedSdr) StartCoherentRx() (sdr.ReadClosers, error) {
+	at, err := u.start()
+	if err != nil {
+		return nil, err
+	}
+	return u.Sdr.StartCoherentRxAt(at)
+}
+
+// firstSampleDelay implements the delayedStartSdr interface.
+func (u *uhdTimedSdr) firstSampleDelay() time.Duration {
+	return time.Duration(u.firstSample.Load())
+}
+
+// startTime implements the timedStartSdr interface.
+func (u *uhdTimedSdr) startTime() (time.Duration, time.Time) {
+	return u.startAt, u.wallStart
+}
+
+// uhdClockSources are the 10MHz references UHD devices take as clock_source.
+var uhdClockSources = []string{"internal", "external", "gpsdo", "mimo"}
+
+// uhdOptions are the USRP settings that used to have to be packed into
+// --uhd-args by hand. Zero values leave the device setting unchanged.
+type uhdOptions struct {
+	ClockSource     string
+	MasterClockRate rf.Hz
+}
+
+// parseUhdOptions will parse and check the --uhd-* device flags.
+func parseUhdOptions(flags *pflag.FlagSet, prefix string) (uhdOptions, error) {
+	var (
+		opts uhdOptions
+		err  error
+	)
+
+	opts.ClockSource, err = flags.GetString(prefix + "uhd-clock-source")
+	if err != nil {
+		return opts, err
+	}
+	if opts.ClockSource != "" {
+		valid := false
+		for _, source := range uhdClockSources {
+			valid = valid || source == opts.ClockSource
+		}
+		if !valid {
+			return opts, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("unknown clock source: %s", opts.ClockSource))
+		}
+	}
+
+	clockRate, err := flags.GetString(prefix + "uhd-master-clock-rate")
+	if err != nil {
+		return opts, err
+	}
+	if clockRate != "" {
+		if opts.MasterClockRate, err = rf.ParseHz(clockRate); err != nil {
+			return opts, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("--%suhd-master-clock-rate: %w", prefix, err))
+		}
+	}
+	if opts.MasterClockRate < 0 {
+		return opts, newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("master clock rate can't be negative"))
+	}
+
+	return opts, nil
+}
+
+// Args will add the options that UHD takes as device arguments to args,
+// refusing to silently override anything already set there.
+func (opts uhdOptions) Args(args string) (string, error) {
+	extra := [][2]string{}
+	if opts.ClockSource != "" {
+		extra = append(extra, [2]string{"clock_source", opts.ClockSource})
+	}
+	if opts.MasterClockRate != 0 {
+		extra = append(extra, [2]string{"master_clock_rate", fmt.Sprintf("%d", int64(opts.MasterClockRate))})
+	}
+
+	set := map[string]bool{}
+	for _, kv := range strings.Split(args, ",") {
+		set[strings.TrimSpace(strings.SplitN(kv, "=", 2)[0])] = true
+	}
+
+	parts := []string{}
+	if args != "" {
+		parts = append(parts, args)
+	}
+	for _, kv := range extra {
+		if set[kv[0]] {
+			return "", newSDRError(ErrInvalidFlag, "uhd", fmt.Errorf("%s is set by both a flag and --uhd-args", kv[0]))
+		}
+		parts = append(parts, kv[0]+"="+kv[1])
+	}
+	return strings.Join(parts, ","), nil
 }
 
 // vim: foldmethod=marker
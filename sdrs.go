@@ -21,10 +21,13 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -43,16 +46,26 @@ func RegisterSDRFlagsWithPrefix(c *cobra.Command, prefix string) {
 	flags.String(prefix+"gains", "", "NAME=1.0,NAME2=2.5")
 	flags.String(prefix+"agc", "", "[on|manual]")
 
-	flags.String(prefix+"frequency", "", "frequency to set the SDR to")
+	flags.String(prefix+"frequency", "", "frequency (or channel name, such as adsb) to set the SDR to")
 	flags.Uint(prefix+"sample-rate", 2.5e6, "samples per second")
 
-	for _, addSdrFlags := range allSdrFlags {
-		addSdrFlags(flags, prefix)
+	flags.Duration(prefix+"stall-timeout", 0, "time without samples before the stream is considered stalled (0 to never)")
+	flags.Int(prefix+"stall-reopen", 0, "times to try reopening the SDR after a stall before giving up")
+
+	annotateSDRFlags(flags, prefix, "")
+
+	for _, name := range allSdrNames(allSdrConstructors) {
+		backendFlags := pflag.NewFlagSet("", pflag.ExitOnError)
+		allSdrFlags[name](backendFlags, prefix)
+		annotateSDRFlags(backendFlags, prefix, name)
+		addSDRBackendFlags(flags, backendFlags, name)
 	}
 
 	EnvRegister("RF_", flags)
 
 	c.Flags().AddFlagSet(flags)
+	registerSDRHelp(c)
+	registerSDRCompletions(c, prefix)
 }
 
 // RegisterSDRFlags will set the SDR related flags on the cobra.Command's pflag
@@ -73,12 +86,12 @@ func CreateGainMap(gains string) (map[string]float32, error) {
 	for _, gainSetting := range strings.Split(gains, ",") {
 		gainKV := strings.Split(gainSetting, "=")
 		if len(gainKV) != 2 {
-			return nil, fmt.Errorf("Can't parse gain %s", gainSetting)
+			return nil, newSDRError(ErrInvalidGain, "", fmt.Errorf("Can't parse gain %s", gainSetting))
 		}
 
 		gainValue, err := strconv.ParseFloat(gainKV[1], 32)
 		if err != nil {
-			return nil, err
+			return nil, newSDRError(ErrInvalidGain, "", err)
 		}
 
 		gainsMap[gainKV[0]] = float32(gainValue)
@@ -88,86 +101,182 @@ func CreateGainMap(gains string) (map[string]float32, error) {
 }
 
 func createGainMap(c *cobra.Command, prefix string) (map[string]float32, error) {
-	gains, err := c.Flags().GetString(prefix + "gains")
+	gains, err := sdrFlagString(c, prefix, "gains")
 	if err != nil {
 		return nil, err
 	}
 	return CreateGainMap(gains)
 }
 
+// Config describes the SDR that was set up by OpenSDR (and friends).
+type Config struct {
+	// Prefix is the flag prefix (such as "rx-") the SDR was loaded with.
+	Prefix string
+
+	// Backend is the name of the backend (such as "rtl") that was used.
+	Backend string
+
+	// Frequency is the center frequency the device is tuned to, as reported
+	// by the device, or 0 if --frequency was not set.
+	Frequency rf.Hz
+
+	// SampleRate is the number of samples per second the device is
+	// configured to, as reported by the device.
+	SampleRate uint
+
+	// StartAt is the device time that streaming will start at, for backends
+	// set up for a timed start (such as uhd with --uhd-start-at or
+	// --uhd-sync-pps), or 0.
+	StartAt time.Duration
+
+	// StartTime is StartAt as a wall clock time, or the zero time.Time if
+	// there's no timed start. Unless the device clock was set from the
+	// system clock (such as with --uhd-sync-pps), this is only as good as
+	// the two clocks were lined up when the device was opened.
+	StartTime time.Time
+}
+
+// timedStartSdr is implemented by SDRs that will start streaming at a set
+// time, so that it can be reported in the Config.
+type timedStartSdr interface {
+	startTime() (time.Duration, time.Time)
+}
+
 // LoadSDR will return an sdr.Sdr defined by the configured CLI flags,
-// or an error.
+// or an error. Use OpenSDR to get the full Config (such as the start time of
+// a timed start) as well.
 func LoadSDR(c *cobra.Command) (sdr.Sdr, rf.Hz, uint, error) {
 	return LoadSDRWithPrefix(c, "")
 }
 
 // LoadSDRWithPrefix will return an sdr.Sdr define by the configured CLI flags,
 // as well as the provided prefix prepended to the CLI flags.
+//
+// The caller is expected to Close the returned sdr.Sdr, which releases
+// everything that was set up while loading it. The device is wrapped to do
+// that, so it's an sdr.Receiver or sdr.Transmitter (or can StartCoherentRx)
+// if the device is. Other driver specific types and interfaces are hidden,
+// but the wrapper has an Unwrap() sdr.Sdr method to get at the device.
 func LoadSDRWithPrefix(c *cobra.Command, prefix string) (sdr.Sdr, rf.Hz, uint, error) {
-	dev, err := loadSDRWithPrefix(c, prefix)
+	dev, cfg, closer, err := openSDR(c, prefix, true)
 	if err != nil {
 		return nil, rf.Hz(0), 0, err
 	}
+	return wrapLoadedSdr(dev, closer), cfg.Frequency, cfg.SampleRate, nil
+}
+
+// OpenSDR will return an sdr.Sdr defined by the configured CLI flags, the
+// Config it was set up with, and a function to release everything that was
+// set up, or an error.
+func OpenSDR(c *cobra.Command) (sdr.Sdr, Config, func() error, error) {
+	return OpenSDRWithPrefix(c, "")
+}
+
+// OpenSDRWithPrefix will return an sdr.Sdr defined by the configured CLI
+// flags with the provided prefix prepended to the flag names, the Config it
+// was set up with, and a function to release everything that was set up.
+//
+// The returned function closes the device, along with any wrappers or
+// library state created while loading it, and should be called instead of
+// the device's Close method. It's safe to call more than once. If an error
+// is returned, everything has already been released.
+//
+// If the cobra.Command's context.Context came from Context, the returned
+// function is also registered with OnShutdown.
+func OpenSDRWithPrefix(c *cobra.Command, prefix string) (sdr.Sdr, Config, func() error, error) {
+	return openSDR(c, prefix, false)
+}
 
-	agc, err := c.Flags().GetString(prefix + "agc")
+// openSDR will open the SDR, and register its cleanup as a shutdown hook. If
+// the caller is going to Close the device itself when shutting down (as with
+// LoadSDR), the hook is only run before a forced exit. The cleanup only runs
+// once, so the hook does nothing if the caller got there first.
+func openSDR(c *cobra.Command, prefix string, forcedOnly bool) (sdr.Sdr, Config, func() error, error) {
+	devCleanup := &closers{}
+
+	dev, cfg, err := openSDRWithPrefix(c, prefix, devCleanup)
 	if err != nil {
-		return nil, rf.Hz(0), 0, err
+		devCleanup.Close()
+		return nil, Config{}, nil, err
 	}
 
-	switch agc {
-	case "manual":
-		if err := dev.SetAutomaticGain(false); err != nil {
-			return nil, rf.Hz(0), 0, err
-		}
-	case "on":
-		if err := dev.SetAutomaticGain(true); err != nil {
-			return nil, rf.Hz(0), 0, err
-		}
-	case "":
-		break
-	default:
-		return nil, rf.Hz(0), 0, fmt.Errorf("unknown gain mode")
+	dev, closeDev, err := watchStalls(c, prefix, cfg.Backend, dev, devCleanup)
+	if err != nil {
+		devCleanup.Close()
+		return nil, Config{}, nil, err
+	}
+	cleanup := &closers{}
+	cleanup.Push(closeDev)
+
+	registerReloadableSDR(c, prefix, cfg.Backend, dev, cleanup)
+	onShutdown(commandContext(c), shutdownHook{
+		name:       fmt.Sprintf("close %ssdr (%s)", prefix, cfg.Backend),
+		fn:         func(context.Context) error { return cleanup.Close() },
+		forcedOnly: forcedOnly,
+	})
+	return dev, cfg, cleanup.Close, nil
+}
+
+// openSDRWithPrefix will load and configure the SDR, pushing anything that
+// needs to be released onto cleanup as it goes.
+func openSDRWithPrefix(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, Config, error) {
+	cfg := Config{Prefix: prefix}
+
+	dev, backend, err := loadSDRWithPrefix(c, prefix, cleanup)
+	cfg.Backend = backend
+	if err != nil {
+		return nil, cfg, err
+	}
+
+	agc, err := sdrFlagString(c, prefix, "agc")
+	if err != nil {
+		return nil, cfg, err
+	}
+
+	if err := setAGC(dev, backend, agc); err != nil {
+		return nil, cfg, err
 	}
 
 	gainsMap, err := createGainMap(c, prefix)
 	if err != nil {
-		return nil, rf.Hz(0), 0, err
+		return nil, cfg, newSDRError(ErrInvalidGain, backend, err)
 	}
 
 	if gainsMap != nil {
 		if err := sdr.SetGainStages(dev, gainsMap); err != nil {
-			return nil, rf.Hz(0), 0, err
+			return nil, cfg, newSDRError(ErrInvalidGain, backend, err)
 		}
 	}
 	flags := c.Flags()
 
 	sps, err := flags.GetUint(prefix + "sample-rate")
 	if err != nil {
-		return nil, rf.Hz(0), 0, err
+		return nil, cfg, err
 	}
 
 	if err := dev.SetSampleRate(sps); err != nil {
-		return nil, rf.Hz(0), 0, err
+		return nil, cfg, driverError(backend, err)
 	}
 
 	rsps, err := dev.GetSampleRate()
 	if err == nil {
 		sps = rsps
 	}
+	cfg.SampleRate = sps
 
 	var frequency rf.Hz
-	freqString, err := flags.GetString(prefix + "frequency")
+	freqString, err := sdrFlagString(c, prefix, "frequency")
 	if err != nil {
-		return nil, rf.Hz(0), 0, err
+		return nil, cfg, err
 	}
 
 	if freqString != "" {
-		frequency, err = rf.ParseHz(freqString)
+		frequency, err = ParseFrequency(freqString)
 		if err != nil {
-			return nil, rf.Hz(0), 0, err
+			return nil, cfg, newSDRError(ErrInvalidFlag, backend, err)
 		}
 		if err := dev.SetCenterFrequency(frequency); err != nil {
-			return nil, rf.Hz(0), 0, err
+			return nil, cfg, driverError(backend, err)
 		}
 
 		rFrequency, err := dev.GetCenterFrequency()
@@ -180,22 +289,55 @@ func LoadSDRWithPrefix(c *cobra.Command, prefix string) (sdr.Sdr, rf.Hz, uint, e
 			"frequency.band": frequency.ITUBandName(),
 		}).Info("Center Frequency set")
 	}
+	cfg.Frequency = frequency
 
-	return dev, frequency, sps, nil
+	if timed, ok := dev.(timedStartSdr); ok {
+		cfg.StartAt, cfg.StartTime = timed.startTime()
+	}
+
+	return dev, cfg, nil
+}
+
+// setAGC will set the automatic gain control as given by the --agc flag.
+func setAGC(dev sdr.Sdr, backend, agc string) error {
+	switch agc {
+	case "manual":
+		if err := dev.SetAutomaticGain(false); err != nil {
+			return driverError(backend, err)
+		}
+	case "on":
+		if err := dev.SetAutomaticGain(true); err != nil {
+			return driverError(backend, err)
+		}
+	case "":
+		break
+	default:
+		return newSDRError(ErrInvalidGain, backend, fmt.Errorf("unknown gain mode: %s", agc))
+	}
+	return nil
 }
 
 // sdrConstructor is used internally to register different SDR backends
 // into loadSDRWithPrefix without having a massive switch statement
 // when invoked by LoadSDR (aka LoadSDRWithPrefix)
-type sdrConstructor func(*cobra.Command, string) (sdr.Sdr, error)
+//
+// Constructors must push anything that needs to be released (starting with
+// the device's Close) onto the provided closers as soon as it's acquired,
+// so that a failure later on doesn't leak it.
+type sdrConstructor func(*cobra.Command, string, *closers) (sdr.Sdr, error)
 
 // sdrFlagSet is used internally to register CLI flag arguments when
 // invoked by RegisterSDRFlags (aka RegisterSDRFlagsWithPrefix)
 type sdrFlagSet func(*pflag.FlagSet, string)
 
+// sdrDiscovery is used internally to find the devices a backend can open,
+// when invoked by ListSDRDevices.
+type sdrDiscovery func() ([]SDRDevice, error)
+
 var (
 	allSdrConstructors = map[string]sdrConstructor{}
 	allSdrFlags        = map[string]func(*pflag.FlagSet, string){}
+	allSdrDiscovery    = map[string]sdrDiscovery{}
 )
 
 func allSdrNames(allSdrs map[string]sdrConstructor) []string {
@@ -203,6 +345,7 @@ func allSdrNames(allSdrs map[string]sdrConstructor) []string {
 	for name := range allSdrs {
 		ret = append(ret, name)
 	}
+	sort.Strings(ret)
 	return ret
 }
 
@@ -211,21 +354,69 @@ func addSdr(name string, flags func(*pflag.FlagSet, string), c sdrConstructor) {
 	allSdrConstructors[name] = c
 }
 
+func addSdrDiscovery(name string, discover sdrDiscovery) {
+	allSdrDiscovery[name] = discover
+}
+
+// SDRDevice is an SDR that one of the compiled in backends can open.
+type SDRDevice struct {
+	// Backend is the name of the backend (such as "pluto") that found the
+	// device.
+	Backend string
+
+	// Flags are the backend flags (without a prefix) that will select this
+	// device, such as pluto-uri=usb:1.5.5.
+	Flags map[string]string
+
+	// Info is what's known about the device without opening it.
+	Info sdr.HardwareInfo
+}
+
+// ListSDRDevices will return the SDRs that can be found by the compiled in
+// backends. Backends that fail are logged and skipped, so one broken driver
+// won't hide the rest.
+func ListSDRDevices() []SDRDevice {
+	ret := []SDRDevice{}
+	names := []string{}
+	for name := range allSdrDiscovery {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		devices, err := allSdrDiscovery[name]()
+		if err != nil {
+			log.WithError(err).WithField("sdr.backend", name).Warn("cli: can't list devices")
+			continue
+		}
+		ret = append(ret, devices...)
+	}
+	return ret
+}
+
 // loadSDRWithPrefix will return an sdr.Sdr defined by the configured CLI flags,
-// or an error.
-func loadSDRWithPrefix(c *cobra.Command, prefix string) (sdr.Sdr, error) {
+// along with the name of the backend used, or an error.
+func loadSDRWithPrefix(c *cobra.Command, prefix string, cleanup *closers) (sdr.Sdr, string, error) {
 	flags := c.Flags()
 
 	sdrType, err := flags.GetString(prefix + "sdr")
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	sdrConstructor, ok := allSdrConstructors[sdrType]
 	if !ok {
-		return nil, fmt.Errorf("rfutil: unknown sdr type: %s", sdrType)
+		return nil, sdrType, newSDRError(ErrUnknownBackend, sdrType, nil)
+	}
+
+	if err := checkSDRBackendFlags(flags, prefix, sdrType); err != nil {
+		return nil, sdrType, err
+	}
+	dev, err := sdrConstructor(c, prefix, cleanup)
+	if err != nil {
+		return nil, sdrType, driverError(sdrType, err)
 	}
-	return sdrConstructor(c, prefix)
+	return dev, sdrType, nil
 }
 
 // vim: foldmethod=marker
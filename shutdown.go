@@ -0,0 +1,143 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// forcedShutdownTimeout is how long shutdown hooks get to run before a
+// forced exit, such as after a second C-c or a hung shutdown.
+const forcedShutdownTimeout = time.Second
+
+// shutdownHook is a function registered by OnShutdown.
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+
+	// forcedOnly hooks are only run before a forced exit, for things the
+	// program is expected to clean up itself on the way out (such as a
+	// device from LoadSDR, which the caller Closes).
+	forcedOnly bool
+}
+
+// shutdownHooks is the stack of hooks registered against a Context. Hooks
+// are run most recent first, and each is only ever run once.
+type shutdownHooks struct {
+	lock  sync.Mutex
+	hooks []shutdownHook
+}
+
+type shutdownHooksKey struct{}
+
+// add will push a hook onto the stack.
+func (s *shutdownHooks) add(hook shutdownHook) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// Run will run the hooks that haven't run yet, most recent first, sharing
+// one deadline. If forced is false, forcedOnly hooks are left for later. If
+// the deadline passes while a hook is still running, Run returns without
+// waiting on it, and without running the rest.
+func (s *shutdownHooks) Run(timeout time.Duration, forced bool) {
+	s.lock.Lock()
+	hooks := []shutdownHook{}
+	kept := []shutdownHook{}
+	for _, hook := range s.hooks {
+		if hook.forcedOnly && !forced {
+			kept = append(kept, hook)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	s.hooks = kept
+	s.lock.Unlock()
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	running := make(chan string, len(hooks))
+	go func() {
+		defer close(done)
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if ctx.Err() != nil {
+				return
+			}
+			hook := hooks[i]
+			running <- hook.name
+			if err := hook.fn(ctx); err != nil {
+				log.WithError(err).WithField("hook", hook.name).Warn("cli: shutdown hook failed")
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		var name string
+		for len(running) > 0 {
+			name = <-running
+		}
+		log.WithField("hook", name).Warnf("cli: shutdown hooks didn't finish in %s", timeout)
+	}
+}
+
+// OnShutdown will register a function to run when the Context returned by
+// Context is shut down, such as to stop a transmitter or finish writing a
+// file's header.
+//
+// Hooks run most recent first, with a shared deadline of --shutdown-grace,
+// when the CancelFunc returned by Context is called. They also run (with
+// whatever hasn't run yet) before the process is forced to exit, after a
+// second C-c or a hung shutdown, so they must be safe to call while the rest
+// of the program is stuck.
+//
+// Hooks registered against a context.Context that didn't come from Context
+// are never run, and a warning is logged.
+func OnShutdown(ctx context.Context, name string, fn func(context.Context) error) {
+	if !onShutdown(ctx, shutdownHook{name: name, fn: fn}) {
+		log.WithField("hook", name).Warn("cli.OnShutdown: context isn't from cli.Context, hook won't run")
+	}
+}
+
+// onShutdown will register the hook, returning false if the context.Context
+// didn't come from Context.
+func onShutdown(ctx context.Context, hook shutdownHook) bool {
+	hooks, ok := ctx.Value(shutdownHooksKey{}).(*shutdownHooks)
+	if !ok {
+		return false
+	}
+	hooks.add(hook)
+	return true
+}
+
+// vim: foldmethod=marker
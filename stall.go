@@ -0,0 +1,534 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"hz.tools/rf"
+	"hz.tools/sdr"
+)
+
+// stallSdr wraps an SDR opened with --stall-timeout, so that readers from
+// StartRx notice when samples stop coming. If --stall-reopen is set, the
+// device underneath is closed and opened again from the flags, which is why
+// every call goes through the lock.
+type stallSdr struct {
+	c       *cobra.Command
+	prefix  string
+	backend string
+	timeout time.Duration
+
+	lock    sync.Mutex
+	dev     sdr.Sdr
+	cleanup *closers
+	reopens int
+	closed  bool
+}
+
+// stallTransceiver is a stallSdr around an SDR that can also transmit.
+type stallTransceiver struct {
+	*stallSdr
+}
+
+// stallCoherentReceiver and stallCoherentTransceiver are around SDRs that
+// can also start a set of phase aligned receivers, such as a multi-channel
+// uhd device. Those streams aren't watched, so StartCoherentRx is refused.
+type (
+	stallCoherentReceiver struct {
+		*stallSdr
+	}
+
+	stallCoherentTransceiver struct {
+		stallTransceiver
+	}
+)
+
+// delayedStartSdr is implemented by SDRs whose streams start some time after
+// StartRx returns (such as uhd with --uhd-start-at), so the stall clock can
+// start from when the first sample is expected.
+type delayedStartSdr interface {
+	firstSampleDelay() time.Duration
+}
+
+// firstSampleAt will return when the first sample from a stream that dev
+// just started is expected.
+func firstSampleAt(dev sdr.Sdr) time.Time {
+	now := time.Now()
+	if delayed, ok := dev.(delayedStartSdr); ok {
+		if delay := delayed.firstSampleDelay(); delay > 0 {
+			return now.Add(delay)
+		}
+	}
+	return now
+}
+
+// minStallTimeout is the shortest --stall-timeout. The reader is checked on
+// every quarter of it, which has to be a usable ticker interval.
+const minStallTimeout = 10 * time.Millisecond
+
+// watchStalls will wrap dev if --stall-timeout is set, returning the SDR to
+// use and a function to release it (and whatever it's been reopened as).
+// The wrapper is an sdr.Receiver, and an sdr.Transmitter or coherentSdr if
+// dev is, but any other driver specific interfaces are hidden. Devices that
+// can only start coherent streams (such as kerberos-coherent) are refused.
+func watchStalls(c *cobra.Command, prefix, backend string, dev sdr.Sdr, cleanup *closers) (sdr.Sdr, func() error, error) {
+	flags := c.Flags()
+	timeout, err := flags.GetDuration(prefix + "stall-timeout")
+	if err != nil {
+		return nil, nil, err
+	}
+	reopens, err := flags.GetInt(prefix + "stall-reopen")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if timeout == 0 {
+		return dev, cleanup.Close, nil
+	}
+	if timeout < 0 || reopens < 0 {
+		return nil, nil, newSDRError(ErrInvalidFlag, backend, fmt.Errorf(
+			"--%sstall-timeout and --%sstall-reopen can't be negative", prefix, prefix,
+		))
+	}
+	if timeout < minStallTimeout {
+		return nil, nil, newSDRError(ErrInvalidFlag, backend, fmt.Errorf(
+			"--%sstall-timeout can't be less than %s", prefix, minStallTimeout,
+		))
+	}
+	_, isCoherent := dev.(coherentSdr)
+	if _, ok := dev.(sdr.Receiver); !ok {
+		if isCoherent {
+			return nil, nil, newSDRError(ErrInvalidFlag, backend, fmt.Errorf(
+				"--%sstall-timeout can't watch coherent streams", prefix,
+			))
+		}
+		return dev, cleanup.Close, nil
+	}
+
+	s := &stallSdr{
+		c:       c,
+		prefix:  prefix,
+		backend: backend,
+		timeout: timeout,
+		dev:     dev,
+		cleanup: cleanup,
+		reopens: reopens,
+	}
+	_, isTx := dev.(sdr.Transmitter)
+	switch {
+	case isTx && isCoherent:
+		return stallCoherentTransceiver{stallTransceiver{s}}, s.Close, nil
+	case isTx:
+		return stallTransceiver{s}, s.Close, nil
+	case isCoherent:
+		return stallCoherentReceiver{s}, s.Close, nil
+	default:
+		return s, s.Close, nil
+	}
+}
+
+func (s *stallSdr) current() sdr.Sdr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dev
+}
+
+// Close implements the sdr.Sdr interface, releasing everything that was set
+// up while loading the device.
+func (s *stallSdr) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return s.cleanup.Close()
+}
+
+// SetCenterFrequency implements the sdr.Sdr interface.
+func (s *stallSdr) SetCenterFrequency(freq rf.Hz) error {
+	return s.current().SetCenterFrequency(freq)
+}
+
+// GetCenterFrequency implements the sdr.Sdr interface.
+func (s *stallSdr) GetCenterFrequency() (rf.Hz, error) {
+	return s.current().GetCenterFrequency()
+}
+
+// SetAutomaticGain implements the sdr.Sdr interface.
+func (s *stallSdr) SetAutomaticGain(agc bool) error {
+	return s.current().SetAutomaticGain(agc)
+}
+
+// GetGainStages implements the sdr.Sdr interface.
+func (s *stallSdr) GetGainStages() (sdr.GainStages, error) {
+	return s.current().GetGainStages()
+}
+
+// GetGain implements the sdr.Sdr interface.
+func (s *stallSdr) GetGain(stage sdr.GainStage) (float32, error) {
+	return s.current().GetGain(stage)
+}
+
+// SetGain implements the sdr.Sdr interface.
+func (s *stallSdr) SetGain(stage sdr.GainStage, gain float32) error {
+	return s.current().SetGain(stage, gain)
+}
+
+// SetSampleRate implements the sdr.Sdr interface.
+func (s *stallSdr) SetSampleRate(sps uint) error {
+	return s.current().SetSampleRate(sps)
+}
+
+// GetSampleRate implements the sdr.Sdr interface.
+func (s *stallSdr) GetSampleRate() (uint, error) {
+	return s.current().GetSampleRate()
+}
+
+// SampleFormat implements the sdr.Sdr interface.
+func (s *stallSdr) SampleFormat() sdr.SampleFormat {
+	return s.current().SampleFormat()
+}
+
+// HardwareInfo implements the sdr.Sdr interface.
+func (s *stallSdr) HardwareInfo() sdr.HardwareInfo {
+	return s.current().HardwareInfo()
+}
+
+// StartTx implements the sdr.Transmitter interface.
+func (s stallTransceiver) StartTx() (sdr.WriteCloser, error) {
+	tx, ok := s.current().(sdr.Transmitter)
+	if !ok {
+		return nil, sdr.ErrNotSupported
+	}
+	return tx.StartTx()
+}
+
+// startCoherentRx refuses to start coherent streams, since they'd go
+// unwatched.
+func (s *stallSdr) startCoherentRx() (sdr.ReadClosers, error) {
+	return nil, newSDRError(ErrUnsupportedSetting, s.backend, fmt.Errorf(
+		"--%sstall-timeout can't watch coherent streams, only StartRx", s.prefix,
+	))
+}
+
+// StartCoherentRx implements the coherentSdr interface.
+func (s stallCoherentReceiver) StartCoherentRx() (sdr.ReadClosers, error) {
+	return s.startCoherentRx()
+}
+
+// StartCoherentRx implements the coherentSdr interface.
+func (s stallCoherentTransceiver) StartCoherentRx() (sdr.ReadClosers, error) {
+	return s.startCoherentRx()
+}
+
+// StartRx implements the sdr.Receiver interface. The Context from Context is
+// cancelled with ErrStreamStalled as the Cause if the returned reader gets
+// no samples for --stall-timeout (and reopening the device didn't help).
+// Reads need to keep up from when the first sample is expected, or that
+// counts as a stall too.
+func (s *stallSdr) StartRx() (sdr.ReadCloser, error) {
+	dev := s.current()
+	rx, ok := dev.(sdr.Receiver)
+	if !ok {
+		return nil, sdr.ErrNotSupported
+	}
+	r, err := rx.StartRx()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := commandContext(s.c)
+	stats, untrack := trackStream(ctx, fmt.Sprintf("--%ssdr=%s", s.prefix, s.backend), r.SampleRate())
+	sr := &stallReader{
+		s:       s,
+		ctx:     ctx,
+		stats:   stats,
+		untrack: untrack,
+		r:       r,
+		done:    make(chan struct{}),
+	}
+	sr.last.Store(firstSampleAt(dev).UnixNano())
+	go sr.watch()
+	return sr, nil
+}
+
+// reopen will close the device, and try to open it again (and start
+// receiving) up to --stall-reopen times in all, waiting --stall-timeout
+// between tries. When the first sample from the new reader is expected is
+// returned along with it.
+func (s *stallSdr) reopen(ctx context.Context) (sdr.ReadCloser, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cleanup.Close()
+	err := fmt.Errorf("%w: no samples for %s", ErrStreamStalled, s.timeout)
+	s.dev = stalledSdr{err: err}
+	for s.reopens > 0 && !s.closed {
+		s.reopens--
+
+		var r sdr.ReadCloser
+		cleanup := &closers{}
+		dev, _, openErr := openSDRWithPrefix(s.c, s.prefix, cleanup)
+		if openErr == nil {
+			r, openErr = dev.(sdr.Receiver).StartRx()
+		}
+		if openErr == nil {
+			s.dev, s.cleanup = dev, cleanup
+			log.WithFields(log.Fields{
+				"sdr.prefix":       s.prefix,
+				"sdr.backend":      s.backend,
+				"sdr.reopens.left": s.reopens,
+			}).Info("Stream stalled, SDR reopened")
+			return r, firstSampleAt(dev), nil
+		}
+		cleanup.Close()
+		err = fmt.Errorf("%w: can't reopen: %s", ErrStreamStalled, openErr)
+		log.WithError(openErr).WithField("sdr.prefix", s.prefix).Warn("Stream stalled, SDR didn't reopen")
+
+		s.dev = stalledSdr{err: err}
+
+		if s.reopens > 0 {
+			// Close (and anything else using the device, which gets
+			// the error for now) shouldn't have to wait this out.
+			s.lock.Unlock()
+			sleepErr := sleepContext(ctx, s.timeout)
+			s.lock.Lock()
+			if sleepErr != nil {
+				return nil, time.Time{}, sleepErr
+			}
+		}
+	}
+	return nil, time.Time{}, err
+}
+
+// stalledSdr stands in for a device that stalled and was closed, while it's
+// being reopened or once that's been given up on. Everything returns the
+// error that says why.
+type stalledSdr struct {
+	err error
+}
+
+// Close implements the sdr.Sdr interface.
+func (s stalledSdr) Close() error { return nil }
+
+// SetCenterFrequency implements the sdr.Sdr interface.
+func (s stalledSdr) SetCenterFrequency(rf.Hz) error { return s.err }
+
+// GetCenterFrequency implements the sdr.Sdr interface.
+func (s stalledSdr) GetCenterFrequency() (rf.Hz, error) { return 0, s.err }
+
+// SetAutomaticGain implements the sdr.Sdr interface.
+func (s stalledSdr) SetAutomaticGain(bool) error { return s.err }
+
+// GetGainStages implements the sdr.Sdr interface.
+func (s stalledSdr) GetGainStages() (sdr.GainStages, error) { return nil, s.err }
+
+// GetGain implements the sdr.Sdr interface.
+func (s stalledSdr) GetGain(sdr.GainStage) (float32, error) { return 0, s.err }
+
+// SetGain implements the sdr.Sdr interface.
+func (s stalledSdr) SetGain(sdr.GainStage, float32) error { return s.err }
+
+// SetSampleRate implements the sdr.Sdr interface.
+func (s stalledSdr) SetSampleRate(uint) error { return s.err }
+
+// GetSampleRate implements the sdr.Sdr interface.
+func (s stalledSdr) GetSampleRate() (uint, error) { return 0, s.err }
+
+// SampleFormat implements the sdr.Sdr interface.
+func (s stalledSdr) SampleFormat() sdr.SampleFormat { return 0 }
+
+// HardwareInfo implements the sdr.Sdr interface.
+func (s stalledSdr) HardwareInfo() sdr.HardwareInfo { return sdr.HardwareInfo{} }
+
+// StartRx implements the sdr.Receiver interface.
+func (s stalledSdr) StartRx() (sdr.ReadCloser, error) { return nil, s.err }
+
+// StartTx implements the sdr.Transmitter interface.
+func (s stalledSdr) StartTx() (sdr.WriteCloser, error) { return nil, s.err }
+
+// stallReader is a reader from a stallSdr. The watch goroutine swaps r out
+// when the device is reopened, and Reads that fail because of it are tried
+// again on the new reader.
+type stallReader struct {
+	s       *stallSdr
+	ctx     context.Context
+	stats   *streamStats
+	untrack func()
+
+	// last is when the stall clock was last reset, in nanoseconds since the
+	// Unix epoch. It's in the future while waiting on a delayed start.
+	last atomic.Int64
+
+	lock   sync.Mutex
+	r      sdr.ReadCloser
+	gen    int
+	err    error
+	closed bool
+
+	// ready is closed once reopening is done, and is nil otherwise.
+	ready chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Read implements the sdr.Reader interface.
+func (sr *stallReader) Read(buf sdr.Samples) (int, error) {
+	for {
+		sr.lock.Lock()
+		r, gen, ready, err := sr.r, sr.gen, sr.ready, sr.err
+		sr.lock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if ready != nil {
+			<-ready
+			continue
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			sr.last.Store(time.Now().UnixNano())
+			sr.stats.add(n)
+		}
+		if err == nil || n > 0 {
+			return n, err
+		}
+
+		sr.lock.Lock()
+		retry := sr.gen != gen || sr.ready != nil || sr.err != nil
+		sr.lock.Unlock()
+		if !retry {
+			return n, err
+		}
+	}
+}
+
+// SampleFormat implements the sdr.Reader interface.
+func (sr *stallReader) SampleFormat() sdr.SampleFormat {
+	return sr.reader().SampleFormat()
+}
+
+// SampleRate implements the sdr.Reader interface.
+func (sr *stallReader) SampleRate() uint {
+	return sr.reader().SampleRate()
+}
+
+// Close implements the sdr.Closer interface.
+func (sr *stallReader) Close() error {
+	sr.closeOnce.Do(func() {
+		close(sr.done)
+		sr.untrack()
+	})
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if sr.closed {
+		return nil
+	}
+	sr.closed = true
+	if sr.ready != nil {
+		// Already closed by recover, which will close the new one.
+		return nil
+	}
+	return sr.r.Close()
+}
+
+func (sr *stallReader) reader() sdr.ReadCloser {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	return sr.r
+}
+
+// watch will check for samples every quarter of --stall-timeout, until the
+// reader is closed or the Context is done.
+func (sr *stallReader) watch() {
+	ticker := time.NewTicker(sr.s.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sr.done:
+			return
+		case <-sr.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(time.Unix(0, sr.last.Load())) < sr.s.timeout {
+			continue
+		}
+		if !sr.recover() {
+			return
+		}
+	}
+}
+
+// recover will close the stalled reader, which should unblock a pending
+// Read, and reopen the device. If that doesn't work, the Context is
+// cancelled with ErrStreamStalled, and false is returned.
+func (sr *stallReader) recover() bool {
+	log.WithFields(log.Fields{
+		"sdr.prefix":  sr.s.prefix,
+		"sdr.backend": sr.s.backend,
+	}).Warnf("No samples for %s", sr.s.timeout)
+
+	sr.lock.Lock()
+	ready := make(chan struct{})
+	sr.ready = ready
+	old := sr.r
+	sr.lock.Unlock()
+	old.Close()
+
+	r, first, err := sr.s.reopen(sr.ctx)
+
+	sr.lock.Lock()
+	switch {
+	case err != nil:
+		// The old reader is already closed, so there's nothing left for
+		// Close to do.
+		sr.err = err
+		sr.closed = true
+	case sr.closed:
+		r.Close()
+	default:
+		sr.r = r
+		sr.gen++
+		sr.last.Store(first.UnixNano())
+	}
+	sr.ready = nil
+	sr.lock.Unlock()
+	close(ready)
+
+	if err != nil {
+		cancelWithCause(sr.ctx, ErrStreamStalled)
+		return false
+	}
+	return true
+}
+
+// vim: foldmethod=marker
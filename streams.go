@@ -0,0 +1,98 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paul@k3xec.com>, 2023
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package cli
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamStats counts the samples read from a stream, for diagnostic dumps.
+type streamStats struct {
+	name  string
+	rate  uint
+	start time.Time
+
+	samples atomic.Uint64
+
+	// last is when a sample was last read, in nanoseconds since the Unix
+	// epoch, or 0 if none have been.
+	last atomic.Int64
+}
+
+// add will count n samples as read just now.
+func (s *streamStats) add(n int) {
+	if n <= 0 {
+		return
+	}
+	s.samples.Add(uint64(n))
+	s.last.Store(time.Now().UnixNano())
+}
+
+// streamRegistry is the set of streams being read under a Context, as
+// tracked by the reader wrappers (such as from --stall-timeout or
+// LimitReader).
+type streamRegistry struct {
+	lock    sync.Mutex
+	streams []*streamStats
+}
+
+type streamRegistryKey struct{}
+
+// trackStream will start counting the samples read from a stream, and add it
+// to the Context's streamRegistry, if there is one. The returned function
+// takes it back out.
+func trackStream(ctx context.Context, name string, rate uint) (*streamStats, func()) {
+	s := &streamStats{name: name, rate: rate, start: time.Now()}
+
+	reg, ok := ctx.Value(streamRegistryKey{}).(*streamRegistry)
+	if !ok {
+		return s, func() {}
+	}
+	reg.lock.Lock()
+	reg.streams = append(reg.streams, s)
+	reg.lock.Unlock()
+
+	var once sync.Once
+	return s, func() {
+		once.Do(func() {
+			reg.lock.Lock()
+			defer reg.lock.Unlock()
+			for i, other := range reg.streams {
+				if other == s {
+					reg.streams = append(reg.streams[:i], reg.streams[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+// snapshot will return the streams being tracked right now.
+func (reg *streamRegistry) snapshot() []*streamStats {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	return append([]*streamStats{}, reg.streams...)
+}
+
+// vim: foldmethod=marker